@@ -0,0 +1,202 @@
+package groWs
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrAccessDenied is returned if the ACL denies an action of a client
+var ErrAccessDenied = errors.New("access denied")
+
+// DefaultRoleMetaKey is the client metadata key the ACL reads the roles of a client from
+const DefaultRoleMetaKey = "Role"
+
+// Action is an action of a client that can be restricted by the ACL
+type Action string
+
+const (
+	// ActionEmit is sending an event to the server (checked before ClientHandler.OnEvent handlers)
+	ActionEmit Action = "emit"
+	// ActionReceive is receiving an event from the server (checked on every Client.Write)
+	ActionReceive Action = "receive"
+	// ActionJoin is joining a room (checked by AddClientToRoom)
+	ActionJoin Action = "join"
+)
+
+// AuditRecord describes an action denied by the ACL
+type AuditRecord struct {
+	// Client is the client whose action was denied
+	Client *Client
+	// Action is the denied action
+	Action Action
+	// Target is the event identifier or room id
+	Target string
+	// Roles are the roles of the client at the time of the check
+	Roles []string
+	// Time is the time of the denial
+	Time time.Time
+}
+
+// ACL declares which roles may emit or receive events and join rooms
+// Targets (event identifiers and room ids) are matched like event patterns (e.g. "admin.*" or "tenant.**")
+// If multiple rules match a target, only the most specific one is applied.
+// Targets without a matching rule are allowed, use the pattern "*" to deny everything not explicitly allowed.
+type ACL struct {
+	mu       sync.RWMutex
+	roles    func(client *Client) []string
+	rules    map[Action]map[string][]string
+	onDenied func(record AuditRecord)
+}
+
+// NewACL creates an empty ACL reading the roles of a client from the DefaultRoleMetaKey metadata
+func NewACL() *ACL {
+	return &ACL{
+		roles: RolesFromMeta(DefaultRoleMetaKey),
+		rules: map[Action]map[string][]string{
+			ActionEmit:    make(map[string][]string),
+			ActionReceive: make(map[string][]string),
+			ActionJoin:    make(map[string][]string),
+		},
+	}
+}
+
+// RolesFromMeta returns a function reading the roles of a client from a metadata key
+// The metadata value can be a string, []string or []interface{} of strings (e.g. from JWT claims)
+func RolesFromMeta(key string) func(client *Client) []string {
+	return func(client *Client) []string {
+		value, err := client.GetMeta(key)
+		if err != nil {
+			return nil
+		}
+		switch roles := value.(type) {
+		case string:
+			return []string{roles}
+		case []string:
+			return roles
+		case []interface{}:
+			result := make([]string, 0, len(roles))
+			for _, role := range roles {
+				result = append(result, fmt.Sprint(role))
+			}
+			return result
+		default:
+			return []string{fmt.Sprint(roles)}
+		}
+	}
+}
+
+// SetRoleFunc sets the function used to get the roles (or claims) of a client
+func (acl *ACL) SetRoleFunc(f func(client *Client) []string) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+	acl.roles = f
+}
+
+// OnDenied sets a hook that is called for every denied action (e.g. for audit logging)
+// Messages of broadcasts a client is not allowed to receive are dropped and only reported to this hook.
+func (acl *ACL) OnDenied(f func(record AuditRecord)) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+	acl.onDenied = f
+}
+
+// Allow allows the roles to perform the action on targets matching the pattern
+// Calling Allow without roles denies the action for everyone
+func (acl *ACL) Allow(action Action, pattern string, roles ...string) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+	if acl.rules[action] == nil {
+		acl.rules[action] = make(map[string][]string)
+	}
+	acl.rules[action][pattern] = append(acl.rules[action][pattern], roles...)
+}
+
+// AllowEmit allows the roles to send events matching the pattern
+func (acl *ACL) AllowEmit(pattern string, roles ...string) {
+	acl.Allow(ActionEmit, pattern, roles...)
+}
+
+// AllowReceive allows the roles to receive events matching the pattern
+func (acl *ACL) AllowReceive(pattern string, roles ...string) {
+	acl.Allow(ActionReceive, pattern, roles...)
+}
+
+// AllowJoin allows the roles to join rooms matching the pattern
+func (acl *ACL) AllowJoin(pattern string, roles ...string) {
+	acl.Allow(ActionJoin, pattern, roles...)
+}
+
+// IsAllowed checks if the client is allowed to perform the action on the target
+func (acl *ACL) IsAllowed(client *Client, action Action, target string) bool {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+	allowed, _ := acl.check(client, action, target)
+	return allowed
+}
+
+// hasRules checks if there is at least one rule for the action
+func (acl *ACL) hasRules(action Action) bool {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+	return len(acl.rules[action]) > 0
+}
+
+// check returns if the action is allowed and the roles of the client (mu must be held)
+func (acl *ACL) check(client *Client, action Action, target string) (bool, []string) {
+	pattern, ok := bestEventPattern(acl.rules[action], target)
+	if !ok {
+		return true, nil
+	}
+	roles := acl.roles(client)
+	for _, allowed := range acl.rules[action][pattern] {
+		for _, role := range roles {
+			if role == allowed {
+				return true, roles
+			}
+		}
+	}
+	return false, roles
+}
+
+// authorize checks if the action is allowed and reports a denial to the audit hook
+func (acl *ACL) authorize(client *Client, action Action, target string) error {
+	acl.mu.RLock()
+	allowed, roles := acl.check(client, action, target)
+	onDenied := acl.onDenied
+	acl.mu.RUnlock()
+	if allowed {
+		return nil
+	}
+	if onDenied != nil {
+		onDenied(AuditRecord{Client: client, Action: action, Target: target, Roles: roles, Time: time.Now()})
+	}
+	return ErrAccessDenied
+}
+
+// authorizeOrReply authorizes the action and sends an error event to the client if it is denied
+func (acl *ACL) authorizeOrReply(client *Client, action Action, target string) error {
+	if acl == nil {
+		return nil
+	}
+	if err := acl.authorize(client, action, target); err != nil {
+		_ = client.WriteEvent(NewErrorEvent(ErrorCodeForbidden, target,
+			fmt.Sprintf("not allowed to %s %s", action, target), nil))
+		return err
+	}
+	return nil
+}
+
+// authorizeReceive checks if the client is allowed to receive the data if it is an event
+// The data is only parsed if there is at least one receive rule
+func (acl *ACL) authorizeReceive(client *Client, data []byte) error {
+	if acl == nil || !acl.hasRules(ActionReceive) {
+		return nil
+	}
+	event, err := client.envelope().Parse(data)
+	if err != nil {
+		return nil
+	}
+	return acl.authorize(client, ActionReceive, event.Identifier)
+}
@@ -0,0 +1,84 @@
+package groWs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestACLIsAllowed(t *testing.T) {
+	acl := NewACL()
+	acl.AllowEmit("admin.**", "admin")
+	acl.AllowEmit("admin.stats", "admin", "support")
+	acl.AllowJoin("*", "user", "admin")
+
+	admin, support, anonymous := &Client{meta: map[string]interface{}{"Role": "admin"}},
+		&Client{meta: map[string]interface{}{"Role": []interface{}{"support", "user"}}},
+		&Client{meta: map[string]interface{}{}}
+
+	tests := []struct {
+		client *Client
+		action Action
+		target string
+		want   bool
+	}{
+		{admin, ActionEmit, "admin.kick", true},
+		{support, ActionEmit, "admin.kick", false},
+		{support, ActionEmit, "admin.stats", true},
+		{anonymous, ActionEmit, "chat.send", true},
+		{anonymous, ActionJoin, "lobby", false},
+		{support, ActionJoin, "lobby", true},
+		{anonymous, ActionReceive, "admin.kick", true},
+	}
+	for _, tt := range tests {
+		if got := acl.IsAllowed(tt.client, tt.action, tt.target); got != tt.want {
+			t.Errorf("IsAllowed(%v, %s, %s) = %v, want %v", tt.client.meta, tt.action, tt.target, got, tt.want)
+		}
+	}
+
+	var denied []AuditRecord
+	acl.OnDenied(func(record AuditRecord) { denied = append(denied, record) })
+	if err := acl.authorize(anonymous, ActionJoin, "lobby"); err != ErrAccessDenied {
+		t.Errorf("expected ErrAccessDenied, got %v", err)
+	}
+	if len(denied) != 1 || denied[0].Target != "lobby" || denied[0].Action != ActionJoin {
+		t.Errorf("unexpected audit records %+v", denied)
+	}
+}
+
+func TestACLPerApp(t *testing.T) {
+	broker := NewMemoryBroker()
+	guarded, err := NewApp(Config{Broker: broker, ChannelPrefix: "guarded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer guarded.pubsub.stop()
+	open, err := NewApp(Config{Broker: broker, ChannelPrefix: "open"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.pubsub.stop()
+	acl := NewACL()
+	acl.AllowReceive("admin.*", "admin")
+	denied := make([]AuditRecord, 0)
+	acl.OnDenied(func(record AuditRecord) {
+		denied = append(denied, record)
+	})
+	guarded.UseACL(acl)
+
+	message, _ := DefaultEventEnvelope.Marshal(Event{Identifier: "admin.kick"})
+	clients := make(map[*App]*Client)
+	for _, app := range []*App{guarded, open} {
+		client := newTestClient("a", "/", nil, time.Now())
+		client.bufferSize = 10
+		client.app = app
+		app.pool.AddClient(client)
+		app.pubsub.deliver(Payload{Kind: PayloadAll, Message: message})
+		clients[app] = client
+	}
+	if len(clients[guarded].buffer) != 0 || len(clients[open].buffer) != 1 {
+		t.Errorf("expected only the client of the app without ACL to receive the event")
+	}
+	if len(denied) != 1 || denied[0].Action != ActionReceive || denied[0].Target != "admin.kick" {
+		t.Errorf("expected the dropped broadcast to be reported, got %+v", denied)
+	}
+}
@@ -2,13 +2,18 @@ package groWs
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
 	"log"
 	"net"
 	"net/http"
 	"regexp"
 	"strconv"
+	"time"
 )
 
 type Config struct {
@@ -20,9 +25,79 @@ type Config struct {
 	Cert   string `json:"cert"`
 	Key    string `json:"key"`
 	// PubSub
-	EnablePubSub bool   `json:"enable_pub_sub"`
-	RedisHost    string `json:"pub_sub_host"`
-	RedisPort    int    `json:"pub_sub_port"`
+	// Broker used to deliver messages across nodes (default: Redis if EnablePubSub is set, else a MemoryBroker)
+	Broker Broker `json:"-"`
+	// ChannelPrefix namespaces the broker channels, so apps sharing a broker do not receive each other's messages
+	ChannelPrefix string `json:"channel_prefix"`
+	// NodeID identifies this node in the cluster (default: random UUID)
+	// Messages published by the node are tagged with it, so the node does not deliver its own messages twice.
+	NodeID string `json:"node_id"`
+	// EnablePresence shares the presence of the clients between the nodes (see GetOnlineClients)
+	EnablePresence bool `json:"enable_presence"`
+	// PresenceInterval is the interval the nodes publish their presence snapshot in (default 10s)
+	// Nodes not publishing for three intervals are considered down.
+	PresenceInterval time.Duration `json:"presence_interval"`
+	// RoomShards hashes the rooms into a fixed number of broker channels (0 = one channel per room)
+	// Nodes only subscribe to the channels of rooms with local clients, so fewer channels mean fewer subscriptions
+	// but more messages for rooms without local clients.
+	RoomShards int `json:"room_shards"`
+	// BrokerHealthInterval is the interval the broker health is checked in (default 5s, negative disables the checks)
+	BrokerHealthInterval time.Duration `json:"broker_health_interval"`
+	// BrokerPublishTimeout is the time a publish to the broker may take before it fails (default 2s, negative disables it)
+	// It bounds the time the functions sending messages (e.g. Broadcast) block if the broker is not reachable.
+	BrokerPublishTimeout time.Duration `json:"broker_publish_timeout"`
+	EnablePubSub         bool          `json:"enable_pub_sub"`
+	RedisHost            string        `json:"pub_sub_host"`
+	RedisPort            int           `json:"pub_sub_port"`
+	// RedisUsername and RedisPassword authenticate the connection (ACL username or password only)
+	RedisUsername string `json:"pub_sub_username"`
+	RedisPassword string `json:"pub_sub_password"`
+	// RedisDB is the database index (not supported in cluster mode)
+	RedisDB int `json:"pub_sub_db"`
+	// RedisTLS enables TLS, RedisTLSConfig can be used to configure it (e.g. client certificates)
+	RedisTLS       bool        `json:"pub_sub_tls"`
+	RedisTLSConfig *tls.Config `json:"-"`
+	// RedisSentinelMaster enables failover using the sentinels at RedisSentinelAddrs
+	RedisSentinelMaster string   `json:"pub_sub_sentinel_master"`
+	RedisSentinelAddrs  []string `json:"pub_sub_sentinel_addrs"`
+	// RedisClusterAddrs enables cluster mode using the seed nodes
+	RedisClusterAddrs []string `json:"pub_sub_cluster_addrs"`
+	// RedisOptions overrides all Redis fields above
+	RedisOptions *redis.UniversalOptions `json:"-"`
+	// RedisClient is used instead of creating a new client
+	RedisClient redis.UniversalClient `json:"-"`
+	// RedisStreams uses Redis Streams instead of Pub/Sub, so messages published while a node is restarting are
+	// delivered after the restart (requires a stable NodeID, see RedisStreamBroker)
+	RedisStreams bool `json:"redis_streams"`
+	// RedisStreamMaxLen is the approximate number of messages retained per stream (default 10000)
+	RedisStreamMaxLen int64 `json:"redis_stream_max_len"`
+	// RedisStreamTTL is the time a stream is kept without new messages (default 24h, negative keeps the streams forever)
+	RedisStreamTTL time.Duration `json:"redis_stream_ttl"`
+	// Connection limits
+	// MaxConnections caps the concurrent connections of the app (0 = unlimited)
+	MaxConnections int `json:"max_connections"`
+	// ConnectionLimitPolicy is applied if MaxConnections is reached
+	ConnectionLimitPolicy LimitPolicy `json:"connection_limit_policy"`
+	// Session resumption
+	// SessionGracePeriod is the time a disconnected client can resume its session (0 = disabled)
+	SessionGracePeriod time.Duration `json:"session_grace_period"`
+	// SessionBufferSize is the number of messages buffered for a disconnected client (default 100)
+	SessionBufferSize int `json:"session_buffer_size"`
+	// SessionTokenParam is the query param the session token is read from on reconnect (default session_token)
+	SessionTokenParam string `json:"session_token_param"`
+	// Client IDs
+	// IDGenerator generates the ID of new clients (default: DefaultIDGenerator)
+	IDGenerator func(r *http.Request) string `json:"-"`
+	// IDCollisionPolicy is applied if a client is connected with an ID already in use
+	IDCollisionPolicy IDCollisionPolicy `json:"id_collision_policy"`
+	// Subprotocols accepted during the websocket handshake (Sec-WebSocket-Protocol)
+	Subprotocols []string `json:"subprotocols"`
+	// WriteTimeout is the time a write to a client may take before its connection is closed
+	// (default DefaultWriteTimeout, negative disables it)
+	WriteTimeout time.Duration `json:"write_timeout"`
+	// Events
+	// EventEnvelope of the events sent and received by the clients of the app (default: DefaultEventEnvelope)
+	EventEnvelope EventEnvelope `json:"event_envelope"`
 }
 
 type App struct {
@@ -32,18 +107,93 @@ type App struct {
 	handshakeMiddlewares map[string]HandshakeMiddleware
 	receiveMiddlewares   map[string][]ReceiveMiddleware
 	sendMiddlewares      map[string][]SendMiddleware
+	connectionLimits     map[string]ConnectionLimits
 	ctx                  context.Context
+	// pool of the clients connected to the app and pubsub delivering messages to the clients of all nodes
+	pool   *ClientPool
+	pubsub *pubSubClient
+	// ownsBroker reports if the app created the broker (a Config.Broker supplied by the caller is not closed)
+	ownsBroker bool
+	// sessions is the store of resumable sessions (nil if Config.SessionGracePeriod is not set)
+	sessions *sessionStore
+	// acl enforced for the clients of the app (nil if UseACL was not called)
+	acl *ACL
 }
 
-func NewApp(config Config) *App {
+// NewApp creates an app with the config
+// It returns an error if the connection to the broker can not be established
+// The app created last is the default app used by the package-level functions (e.g. Broadcast and GetClientPool),
+// apps created before keep their clients and broker. With multiple apps in one process, use the methods of the
+// app (e.g. App.Namespace, App.Tenant and App.GetClientPool) to publish with the broker and channels of that app.
+func NewApp(config Config) (*App, error) {
+	return newApp(config, true)
+}
+
+// newApp creates an app with the config and makes it the default app
+// A default app that is not owned (created by getPubSubClient) is stopped when it is replaced.
+func newApp(config Config, owned bool) (*App, error) {
 	if config.Port == 0 {
 		config.Port = 8080
 	}
-	if config.EnablePubSub {
+	if config.IDGenerator == nil {
+		config.IDGenerator = DefaultIDGenerator
+	}
+	config.EventEnvelope = config.EventEnvelope.WithDefaults()
+	ownsBroker := config.Broker == nil
+	if config.Broker == nil && config.EnablePubSub {
 		log.Println("PubSub enabled")
-		initPubSubClient(context.Background(), config.RedisHost, config.RedisPort)
+		if config.RedisStreams {
+			broker, err := newRedisStreamBrokerFromConfig(context.Background(), config)
+			if err != nil {
+				return nil, err
+			}
+			config.Broker = broker
+		} else {
+			broker, err := newRedisBrokerFromConfig(context.Background(), config)
+			if err != nil {
+				return nil, err
+			}
+			config.Broker = broker
+		}
 		log.Println("Redis connection established")
 	}
+	if config.Broker == nil {
+		config.Broker = NewMemoryBroker()
+	}
+	if config.NodeID == "" {
+		config.NodeID = uuid.NewString()
+	}
+	if config.BrokerHealthInterval == 0 {
+		config.BrokerHealthInterval = DefaultBrokerHealthInterval
+	}
+	pubSubMu.Lock()
+	defer pubSubMu.Unlock()
+	if !owned && pubSubClientInternal != nil {
+		// created concurrently by another call of getPubSubClient
+		return &App{config: config, pool: clientPool, pubsub: pubSubClientInternal}, nil
+	}
+	pool := newClientPool()
+	if !pubSubOwned {
+		// the first app takes over the clients added using the package-level functions before
+		pool = GetClientPool()
+	}
+	pubsub, err := newPubSubClient(context.Background(), pool, config)
+	if err != nil {
+		if ownsBroker {
+			_ = config.Broker.Close()
+		}
+		return nil, err
+	}
+	if pubSubClientInternal != nil && !pubSubOwned {
+		// and the rooms with presence events enabled before
+		pubSubClientInternal.presenceMu.Lock()
+		for roomId := range pubSubClientInternal.presenceRooms {
+			pubsub.setRoomPresence(roomId, true)
+		}
+		pubSubClientInternal.presenceMu.Unlock()
+		pubSubClientInternal.stop()
+	}
+	clientPool, pubSubClientInternal, pubSubOwned = pool, pubsub, owned
 	return &App{
 		config:               config,
 		server:               NewServer(config.Host + ":" + strconv.Itoa(config.Port)),
@@ -51,14 +201,53 @@ func NewApp(config Config) *App {
 		handshakeMiddlewares: make(map[string]HandshakeMiddleware, 0),
 		receiveMiddlewares:   make(map[string][]ReceiveMiddleware, 0),
 		sendMiddlewares:      make(map[string][]SendMiddleware, 0),
+		connectionLimits:     make(map[string]ConnectionLimits, 0),
 		ctx:                  context.Background(),
-	}
+		pool:                 pool,
+		pubsub:               pubsub,
+		ownsBroker:           ownsBroker,
+		sessions:             newSessionStore(config),
+	}, nil
 }
 
 func (a *App) AddRouter(router *Router) {
 	a.router = router
 }
 
+// UseACL enforces the ACL for all clients of the app
+// (events sent and received by clients and rooms joined using AddClientToRoom)
+// It has to be called before the app serves clients, other apps are not affected.
+func (a *App) UseACL(acl *ACL) {
+	a.acl = acl
+}
+
+// OnBrokerStateChange adds a handler called when the pub/sub broker becomes unreachable or reachable again
+// While the broker is disconnected, messages are only delivered to the clients of this node
+func (a *App) OnBrokerStateChange(handler BrokerStateHandler) {
+	a.pubsub.onStateChange(handler)
+}
+
+// OnPresence adds a handler called for the presence events of the clients of all nodes (requires EnablePresence)
+// The handlers are called concurrently for events of different nodes.
+func (a *App) OnPresence(handler PresenceHandler) {
+	a.pubsub.onPresence(handler)
+}
+
+// NodeID returns the ID of this node in the cluster (see Config.NodeID)
+func (a *App) NodeID() string {
+	return a.config.NodeID
+}
+
+// BrokerState returns the state of the pub/sub broker and the error of the last failed health check or publish
+func (a *App) BrokerState() (BrokerState, error) {
+	return a.pubsub.getState()
+}
+
+// SetConnectionLimits sets the connection limits of a route (equal to the path of the route)
+func (a *App) SetConnectionLimits(route string, limits ConnectionLimits) {
+	a.connectionLimits[route] = limits
+}
+
 // AddHandshakeMiddleware adds a middleware that is called before the websocket handshake
 // only one per route allowed if multiple regex match the same route the first one will be used
 func (a *App) AddHandshakeMiddleware(route string, middleware HandshakeMiddleware) {
@@ -80,14 +269,21 @@ func (a *App) AddSendMiddleware(route string, middleware SendMiddleware) {
 	a.sendMiddlewares[route] = append(a.sendMiddlewares[route], middleware)
 }
 
+// close stops the pub/sub client of the app and closes the broker if the app created it
+func (a *App) close() error {
+	a.pubsub.stop()
+	if a.ownsBroker {
+		return a.config.Broker.Close()
+	}
+	return nil
+}
+
 // ListenAndServe starts the server and listens for incoming connections
 // It will use TLS if the config.UseTLS is set to true and a cert and key are provided
 // It will panic if no router is added (or for TLS no cert or key is provided)
 func (a *App) ListenAndServe() error {
 	defer func() {
-		if pubSubEnabled {
-			_ = getPubSubClient().Close()
-		}
+		_ = a.close()
 	}()
 	if a.router == nil {
 		panic("No router added")
@@ -137,7 +333,8 @@ func (a *App) getMiddlewaresForRoute(route string) (HandshakeMiddleware, []Recei
 
 // buildHandlerFunc builds a http.HandlerFunc that handles the websocket connection
 // it applies the middlewares for the given route
-// HandshakeMiddleware is only applied once per connection and called before loop -> false if client should not connect
+// HandshakeMiddleware is only applied once per connection and called before the upgrade -> false if client should not connect
+// Connection limits are checked after the handshake (so the metadata is available) and before the upgrade
 // ReceiveMiddleware is applied for every Message received (in loop)
 // SendMiddleware is applied to the Client and is called on Client.WriteJSON or Client.Write
 func (a *App) buildHandlerFunc(route string, handler ClientHandler) HandlerFunc {
@@ -152,49 +349,172 @@ func (a *App) buildHandlerFunc(route string, handler ClientHandler) HandlerFunc
 		log.Printf("apply %d SendMiddleware for route %s", len(sendMiddlewares), route)
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Upgrade connection
-		conn, _, _, err := ws.UpgradeHTTP(r, w)
-		if err != nil {
-			panic(err)
+		if a.sessions != nil {
+			if token := a.sessions.tokenFromRequest(r); token != "" {
+				if client := a.sessions.claim(token, route); client != nil {
+					a.resumeSession(w, r, client, handler, handshakeMiddleware, receiveMiddlewares)
+					return
+				}
+			}
 		}
 		// Create client
-		client := NewClient(conn, sendMiddlewares)
+		client := NewClient(nil, sendMiddlewares)
+		client.route = route
+		client.app = a
+		if id := a.config.IDGenerator(r); id != "" {
+			client.SetID(id)
+		}
 
 		// run handshake and check if client is authorized
 		handshakeResult := handshakeMiddleware(r, client)
 		if !handshakeResult {
-			// todo error handling
+			client.runCloseHandlers()
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 			return
 		}
+		// claim the ID and check connection limits
+		limits := connectionLimitsFor(client, a.config.MaxConnections, a.config.ConnectionLimitPolicy,
+			a.connectionLimits[route])
+		replaced, evicted, err := a.pool.admit(client, a.config.IDCollisionPolicy, limits)
+		if errors.Is(err, ErrIDConflict) {
+			client.runCloseHandlers()
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			client.runCloseHandlers()
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		// Upgrade connection
+		conn, _, _, err := a.upgrader().Upgrade(r, w)
+		if err != nil {
+			log.Println(err)
+			a.pool.release(client)
+			client.runCloseHandlers()
+			return
+		}
+		client.setConn(conn)
+		for _, old := range evicted {
+			old.closeWithError(ErrorCodeEvicted, "connection closed by a newer connection")
+		}
+		if replaced != nil {
+			replaced.closeWithError(ErrorCodeReplaced, "connection replaced by a new connection with the same id")
+		}
 
-		go webSocketHandler(client, handler, receiveMiddlewares)
+		go webSocketHandler(client, handler, receiveMiddlewares, false)
+
+	}
+}
+
+// resumeSession attaches a new connection to the client of a claimed session
+// The handshake is run again on the existing client (with its metadata), buffered messages are sent
+// and a previous connection of the client (e.g. a half-open one) is closed
+func (a *App) resumeSession(w http.ResponseWriter, r *http.Request, client *Client, handler ClientHandler,
+	handshakeMiddleware HandshakeMiddleware, receiveMiddlewares []ReceiveMiddleware) {
+	if !handshakeMiddleware(r, client) {
+		a.sessions.release(client)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	conn, _, _, err := a.upgrader().Upgrade(r, w)
+	if err != nil {
+		log.Println(err)
+		a.sessions.release(client)
+		return
+	}
+	if previous := client.setConn(conn); previous != nil {
+		_ = previous.Close()
+	}
+	go webSocketHandler(client, handler, receiveMiddlewares, true)
+}
 
+// sendSession issues a new session token and sends it to the client
+func sendSession(client *Client, handler ClientHandler, resumed bool) error {
+	sessions := client.getSessions()
+	token, err := sessions.issue(client, func() {
+		finalizeClient(client, handler)
+	})
+	if err != nil {
+		return err
+	}
+	return client.WriteEvent(Event{
+		Identifier: SessionEventIdentifier,
+		Data: SessionData{
+			ID:          client.GetID(),
+			Token:       token,
+			Resumed:     resumed,
+			GracePeriod: sessions.grace.Seconds(),
+		},
+	})
+}
+
+// finalizeClient calls OnDisconnect and removes the client from the pool and all rooms
+func finalizeClient(client *Client, handler ClientHandler) {
+	if sessions := client.getSessions(); sessions != nil {
+		sessions.remove(client)
+	}
+	if handler.onDisconnect != nil {
+		if err := handler.onDisconnect(client); err != nil {
+			log.Println(err)
+		}
+	}
+	client.getPool().RemoveClient(client)
+	client.getPool().RemoveClientFromAllRooms(client, client.GetRooms())
+	client.runCloseHandlers()
+}
+
+// upgrader returns the websocket upgrader negotiating the configured subprotocols
+func (a *App) upgrader() ws.HTTPUpgrader {
+	return ws.HTTPUpgrader{
+		Protocol: func(protocol string) bool {
+			for _, p := range a.config.Subprotocols {
+				if p == protocol {
+					return true
+				}
+			}
+			return false
+		},
 	}
 }
 
 // webSocketHandler handles the websocket connection in a loop on a separate goroutine
-func webSocketHandler(client *Client, handler ClientHandler, receiveMiddlewares []ReceiveMiddleware) {
+// OnConnect is not called again for a resumed session
+func webSocketHandler(client *Client, handler ClientHandler, receiveMiddlewares []ReceiveMiddleware, resumed bool) {
 
 	defer func(conn net.Conn) {
 		err := conn.Close()
 		if err != nil {
 			log.Println(err)
 		}
-		err = handler.onDisconnect(client)
-		if err != nil {
-			log.Println(err)
+		if !client.detach(conn) {
+			// connection was replaced by a resumed one
+			return
 		}
-		GetClientPool().RemoveClient(client)
-		GetClientPool().RemoveClientFromAllRooms(client, client.GetRooms())
+		if sessions := client.getSessions(); sessions != nil && sessions.suspend(client) {
+			// finalized after the grace period if the session is not resumed
+			return
+		}
+		finalizeClient(client, handler)
 	}(client.getConn())
-	err := handler.onConnect(client)
-	if err != nil {
-		// todo error handling
-		return
+	if !resumed {
+		if handler.onConnect != nil {
+			err := handler.onConnect(client)
+			if err != nil {
+				// todo error handling
+				return
+			}
+		}
+
+		// add client to pool
+		client.getPool().AddClient(client)
 	}
 
-	// add client to pool
-	GetClientPool().AddClient(client)
+	if client.getSessions() != nil {
+		if err := sendSession(client, handler, resumed); err != nil {
+			log.Println(err)
+		}
+	}
 
 	// authorized, continue with WebSocket connection
 	for {
@@ -207,8 +527,11 @@ func webSocketHandler(client *Client, handler ClientHandler, receiveMiddlewares
 			var middlewareError error
 			for _, middleware := range receiveMiddlewares {
 				msg, middlewareError = middleware(client, msg)
+				if errors.Is(middlewareError, ErrDropMessage) {
+					return
+				}
 				if middlewareError != nil {
-					log.Println("middleware error: ", middlewareError) // todo error handling
+					log.Println("middleware error: ", middlewareError)
 				}
 			}
 			handlerErr := handler.handle(msg, opCode, client)
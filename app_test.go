@@ -1,11 +1,91 @@
 package groWs
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"testing"
+	"time"
 )
 
+func TestNewAppKeepsPreviousApps(t *testing.T) {
+	broker := NewMemoryBroker()
+	first, err := NewApp(Config{Broker: broker})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewApp(Config{Broker: broker})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.pubsub.stop()
+	defer second.pubsub.stop()
+	if first.pubsub.ctx.Err() != nil {
+		t.Fatal("expected the first app to keep running")
+	}
+	if first.pool == second.pool || first.NodeID() == second.NodeID() {
+		t.Fatal("expected the apps to have their own pool and node")
+	}
+	if pubsub, _ := getPubSubClient(); pubsub != second.pubsub || GetClientPool() != second.pool {
+		t.Fatal("expected the last app to be the default")
+	}
+}
+
+func TestAppNamespacePublishesWithOwnBroker(t *testing.T) {
+	first, err := NewApp(Config{Broker: NewMemoryBroker(), ChannelPrefix: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewApp(Config{Broker: NewMemoryBroker(), ChannelPrefix: "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.pubsub.stop()
+	defer second.pubsub.stop()
+	client := newTestClient("first-client", "/", nil, time.Now())
+	client.bufferSize = 10
+	client.app = first
+	first.GetClientPool().AddClient(client)
+	defer first.GetClientPool().RemoveClient(client)
+
+	if err := first.Namespace().BroadcastToAll([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := BroadcastToAll([]byte("default")); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.buffer) != 1 || string(client.buffer[0]) != "first" {
+		t.Fatalf("expected only the message of the first app, got %q", client.buffer)
+	}
+	if first.GetClient("first-client") != client || second.GetClient("first-client") != nil {
+		t.Fatal("expected the client in the pool of the first app only")
+	}
+}
+
+func TestAppCloseKeepsSuppliedBroker(t *testing.T) {
+	broker := NewMemoryBroker()
+	supplied, err := NewApp(Config{Broker: broker})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := NewApp(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := supplied.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Health(context.Background()); err != nil {
+		t.Fatalf("expected the supplied broker to stay open, got %v", err)
+	}
+	if err := created.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := created.config.Broker.Health(context.Background()); err == nil {
+		t.Fatal("expected the broker created by the app to be closed")
+	}
+}
+
 func TestNewApp(t *testing.T) {
 	config := Config{
 		Host:         "localhost",
@@ -48,7 +128,10 @@ func TestNewApp(t *testing.T) {
 	router := NewRouter()
 	router.AddRoute("/test", handler)
 
-	app := NewApp(config)
+	app, err := NewApp(config)
+	if err != nil {
+		t.Skip("redis not available: ", err)
+	}
 	app.AddRouter(router)
 	app.AddHandshakeMiddleware("/test", func(r *http.Request, client *Client) bool {
 		log.Println("Handshake")
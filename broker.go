@@ -0,0 +1,82 @@
+package groWs
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrBrokerClosed is returned if a message is published to a closed broker
+var ErrBrokerClosed = errors.New("broker closed")
+
+// MessageHandler is called for every message received on a subscribed channel
+// Brokers call it for the messages of a subscription in the order they are received (not concurrently).
+type MessageHandler func(channel string, payload []byte)
+
+// Broker transports messages between the nodes of a cluster (e.g. Redis Pub/Sub)
+// groWs publishes all broadcasts to the broker and delivers the messages received from it
+// to the clients connected to the node.
+type Broker interface {
+	// Publish sends the payload to all subscribers of the channel
+	Publish(ctx context.Context, channel string, payload []byte) error
+	// Subscribe calls the handler for every message published to one of the channels
+	// A channel ending with ":*" subscribes to all channels starting with the prefix (e.g. "grows:room:*").
+	// Channels can be added and removed using the returned Subscription.
+	Subscribe(ctx context.Context, handler MessageHandler, channels ...string) (Subscription, error)
+	// Health returns an error if the broker is not reachable
+	Health(ctx context.Context) error
+	// Close closes the connection to the broker
+	Close() error
+}
+
+// Subscription is a set of channels a handler is subscribed to
+type Subscription interface {
+	// Subscribe adds channels to the subscription
+	Subscribe(ctx context.Context, channels ...string) error
+	// Unsubscribe removes channels from the subscription
+	Unsubscribe(ctx context.Context, channels ...string) error
+	// Close removes all channels, the handler is not called afterwards
+	Close() error
+}
+
+// BrokerState is the connectivity state of the broker
+type BrokerState int
+
+const (
+	// BrokerConnected means messages are delivered across all nodes
+	BrokerConnected BrokerState = iota
+	// BrokerDisconnected means the broker is not reachable, messages are only delivered to the clients of this node
+	BrokerDisconnected
+)
+
+// String returns the name of the state
+func (s BrokerState) String() string {
+	if s == BrokerConnected {
+		return "connected"
+	}
+	return "disconnected"
+}
+
+// BrokerStateHandler is called when the broker state changes, err is the error that caused the disconnect
+type BrokerStateHandler func(state BrokerState, err error)
+
+const (
+	// DefaultBrokerHealthInterval is the default interval the broker health is checked in
+	DefaultBrokerHealthInterval = 5 * time.Second
+	// DefaultBrokerPublishTimeout is the default time a publish to the broker may take
+	DefaultBrokerPublishTimeout = 2 * time.Second
+	// minReconnectBackoff and maxReconnectBackoff bound the wait time between reconnect attempts of the brokers
+	minReconnectBackoff = 100 * time.Millisecond
+	maxReconnectBackoff = 30 * time.Second
+)
+
+// nextBackoff doubles the backoff up to maxReconnectBackoff
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff < minReconnectBackoff {
+		return minReconnectBackoff
+	}
+	if backoff*2 > maxReconnectBackoff {
+		return maxReconnectBackoff
+	}
+	return backoff * 2
+}
@@ -0,0 +1,68 @@
+package groWs
+
+import (
+	"hash/fnv"
+	"strconv"
+)
+
+// Channels names the broker channels of the payloads
+// Services publishing without an App (see package publisher) use the same names as the nodes.
+type Channels struct {
+	// Prefix of all channels (see Config.ChannelPrefix)
+	Prefix string
+	// RoomShards is the number of channels the rooms are hashed into (see Config.RoomShards)
+	RoomShards int
+}
+
+// Namespace returns the channel prefix of the tenant
+func (c Channels) Namespace(tenant string) string {
+	if tenant == "" {
+		return c.Prefix
+	}
+	return c.Prefix + ":tenant:" + tenant
+}
+
+// Room returns the channel of a room, or of its shard if RoomShards is set
+// Brokers can route the messages by room (e.g. grows.room.<id> in NATS)
+func (c Channels) Room(tenant string, room string) string {
+	if c.RoomShards <= 0 {
+		return c.Namespace(tenant) + ":room:" + room
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(room))
+	return c.Namespace(tenant) + ":room:shard:" + strconv.Itoa(int(hash.Sum32()%uint32(c.RoomShards)))
+}
+
+// Node returns the channel of the messages sent to a single node
+func (c Channels) Node(id string) string {
+	return c.Prefix + ":node:" + id
+}
+
+// Presence returns the channel of the presence updates
+func (c Channels) Presence() string {
+	return c.Prefix + ":presence"
+}
+
+// Of returns the channel of the payload
+func (c Channels) Of(payload Payload) string {
+	if payload.Node != "" {
+		return c.Node(payload.Node)
+	}
+	namespace := c.Namespace(payload.Tenant)
+	switch payload.Kind {
+	case PayloadClient:
+		return namespace + ":client"
+	case PayloadRoom:
+		return c.Room(payload.Tenant, payload.Id)
+	case PayloadUser:
+		return namespace + ":user"
+	case PayloadDisconnectUser:
+		return namespace + ":user:disconnect"
+	case PayloadControl:
+		return namespace + ":control"
+	case PayloadPresence:
+		return c.Presence()
+	default:
+		return namespace + ":all:clients"
+	}
+}
@@ -7,30 +7,76 @@ import (
 	"github.com/gobwas/ws/wsutil"
 	"github.com/google/uuid"
 	"net"
+	"net/http"
 	"sync"
+	"time"
 )
 
 var ErrMetaNotFound = errors.New("metadata not found")
 
+// ErrIDConflict is returned if a client with the same ID is already connected (see IDCollisionPolicy)
+var ErrIDConflict = errors.New("client id already in use")
+
+// ErrorCodeReplaced is used in the error event sent to a client replaced by a new client with the same ID
+const ErrorCodeReplaced = "replaced"
+
+// IDCollisionPolicy defines what happens if a new client has the ID of a connected client
+// A new client with the ID of a client that is still connecting is always rejected.
+type IDCollisionPolicy int
+
+const (
+	// CollisionReject refuses the websocket upgrade of the new client with 409 Conflict
+	CollisionReject IDCollisionPolicy = iota
+	// CollisionReplace accepts the new client and closes the connection of the old one
+	CollisionReplace
+)
+
+// DefaultIDGenerator generates random (version 4) UUIDs
+func DefaultIDGenerator(*http.Request) string {
+	return uuid.NewString()
+}
+
+// ErrNotConnected is returned if data is written to a client without connection that does not buffer messages
+var ErrNotConnected = errors.New("client not connected")
+
+// DefaultWriteTimeout is the default time a write to a client may take (see Config.WriteTimeout)
+const DefaultWriteTimeout = 10 * time.Second
+
 type Client struct {
 	metaMu sync.RWMutex
 	meta   map[string]interface{}
-	// websocket connection
+	// websocket connection (nil before the upgrade and while a resumable session is disconnected)
+	// writeMu serializes the writes to the connection, connMu only guards the fields below and is never held
+	// while writing, so a stalled connection does not block Close or the eviction of the client
+	writeMu         sync.Mutex
+	connMu          sync.Mutex
 	conn            net.Conn
+	closed          bool
+	buffer          [][]byte
+	bufferSize      int
 	sendMiddlewares []SendMiddleware
 	id              string
+	userID          string
+	tenant          string
 	roomsMu         sync.RWMutex
 	rooms           []string
+	closeMu         sync.Mutex
+	closeHandlers   map[interface{}]func()
+	// app the client is connected to (nil for clients created without App, see getPool)
+	app *App
+	// route the client is connected to and the time it connected
+	route       string
+	connectedAt time.Time
 }
 
 func NewClient(conn net.Conn, middlewares []SendMiddleware) *Client {
-	id, _ := uuid.NewUUID()
 	return &Client{
 		conn:            conn,
 		meta:            make(map[string]interface{}),
 		sendMiddlewares: middlewares,
-		id:              id.String(),
+		id:              uuid.NewString(),
 		rooms:           make([]string, 0),
+		connectedAt:     time.Now(),
 	}
 }
 
@@ -83,27 +129,231 @@ func (c *Client) GetID() string {
 	return c.id
 }
 
-func (c *Client) setID(id string) {
+// SetID sets the ID of the client (e.g. to the authenticated user ID plus device)
+// It must only be called in a HandshakeMiddleware, before the client is added to the pool.
+// If the ID is already in use, the Config.IDCollisionPolicy is applied
+func (c *Client) SetID(id string) {
 	c.id = id
 }
 
+// SetUserID sets the ID of the user the client belongs to
+// A user can have multiple clients (e.g. tabs or devices), that can be addressed together using SendToUser
+func (c *Client) SetUserID(userID string) {
+	c.metaMu.Lock()
+	previous := c.userID
+	c.userID = userID
+	c.metaMu.Unlock()
+	if previous != userID {
+		c.getPool().reindexUser(c, previous)
+	}
+}
+
+// GetUserID returns the ID of the user the client belongs to (empty if not set)
+func (c *Client) GetUserID() string {
+	c.metaMu.RLock()
+	defer c.metaMu.RUnlock()
+	return c.userID
+}
+
+// SetTenant sets the tenant of the client
+// The client only receives messages sent to its tenant namespace (see Tenant), clients without tenant
+// only receive messages of the functions without namespace (e.g. BroadcastEvent)
+func (c *Client) SetTenant(tenant string) {
+	c.metaMu.Lock()
+	previous := c.tenant
+	c.tenant = tenant
+	c.metaMu.Unlock()
+	if previous != tenant {
+		c.getPool().retenant(c)
+	}
+}
+
+// GetTenant returns the tenant of the client (empty if not set)
+func (c *Client) GetTenant() string {
+	c.metaMu.RLock()
+	defer c.metaMu.RUnlock()
+	return c.tenant
+}
+
+// closeWithError sends an error event to the client and closes its connection
+func (c *Client) closeWithError(code string, message string) {
+	_ = c.WriteEvent(NewErrorEvent(code, "", message, nil))
+	_ = c.Close()
+}
+
+// getPool returns the pool of the app of the client (the default pool for clients without app)
+func (c *Client) getPool() *ClientPool {
+	if c.app != nil {
+		return c.app.pool
+	}
+	return GetClientPool()
+}
+
+// getSessions returns the session store of the app of the client (nil if sessions are disabled)
+func (c *Client) getSessions() *sessionStore {
+	if c.app == nil {
+		return nil
+	}
+	return c.app.sessions
+}
+
+// acl returns the ACL of the app of the client (nil if the app does not use an ACL)
+func (c *Client) acl() *ACL {
+	if c.app == nil {
+		return nil
+	}
+	return c.app.acl
+}
+
+// envelope returns the envelope of the events of the client (see Config.EventEnvelope)
+func (c *Client) envelope() EventEnvelope {
+	if c.app == nil {
+		return DefaultEventEnvelope
+	}
+	return c.app.pubsub.envelope
+}
+
+// onClose sets a function that is called after the connection of the client is closed
+// A function set with the same key before is replaced (e.g. when the handshake runs again on resume).
+func (c *Client) onClose(key interface{}, f func()) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closeHandlers == nil {
+		c.closeHandlers = make(map[interface{}]func())
+	}
+	c.closeHandlers[key] = f
+}
+
+// runCloseHandlers calls all functions set with onClose
+func (c *Client) runCloseHandlers() {
+	c.closeMu.Lock()
+	handlers := c.closeHandlers
+	c.closeHandlers = nil
+	c.closeMu.Unlock()
+	for _, f := range handlers {
+		f()
+	}
+}
+
+// setConn sets the connection of the client (after the websocket upgrade or when a session is resumed)
+// Messages buffered while the client was disconnected are written to the new connection before other messages.
+// It returns the previous connection (if any)
+func (c *Client) setConn(conn net.Conn) net.Conn {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.connMu.Lock()
+	previous := c.conn
+	c.conn = conn
+	buffer := c.buffer
+	c.buffer = nil
+	c.connMu.Unlock()
+	for i, data := range buffer {
+		if err := c.writeConn(conn, ws.OpText, data); err != nil {
+			// keep the messages for the next connection of the session
+			c.connMu.Lock()
+			c.buffer = buffer[i:]
+			c.connMu.Unlock()
+			break
+		}
+	}
+	return previous
+}
+
+// writeTimeout returns the time a write to the client may take (see Config.WriteTimeout)
+func (c *Client) writeTimeout() time.Duration {
+	if c.app == nil || c.app.config.WriteTimeout == 0 {
+		return DefaultWriteTimeout
+	}
+	return c.app.config.WriteTimeout
+}
+
+// writeConn writes a frame to the connection within the write timeout (writeMu must be held)
+// The connection is closed if the write fails, as a partially written frame can not be continued.
+func (c *Client) writeConn(conn net.Conn, op ws.OpCode, data []byte) error {
+	if timeout := c.writeTimeout(); timeout > 0 {
+		_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	err := wsutil.WriteServerMessage(conn, op, data)
+	if err != nil {
+		_ = conn.Close()
+	}
+	return err
+}
+
+// detach removes the connection from the client if it is still the current one
+// Messages written afterwards are buffered (if enabled) until a new connection is set
+func (c *Client) detach(conn net.Conn) bool {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.conn != conn {
+		return false
+	}
+	c.conn = nil
+	return true
+}
+
 // getConn returns the connection of the client
 func (c *Client) getConn() net.Conn {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
 	return c.conn
 }
 
+// isClosed checks if the client was closed by the server
+func (c *Client) isClosed() bool {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.closed
+}
+
 // Close closes the connection of the client
+// A closed client can not be resumed, a disconnected session is ended immediately
 func (c *Client) Close() error {
-	return c.conn.Close()
+	c.connMu.Lock()
+	c.closed = true
+	conn := c.conn
+	c.connMu.Unlock()
+	if conn == nil {
+		if sessions := c.getSessions(); sessions != nil {
+			sessions.expire(c)
+		}
+		return nil
+	}
+	return conn.Close()
+}
+
+// writeFrame writes a frame to the connection or buffers text frames if the client is disconnected
+func (c *Client) writeFrame(op ws.OpCode, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.connMu.Lock()
+	conn := c.conn
+	if conn != nil {
+		c.connMu.Unlock()
+		return c.writeConn(conn, op, data)
+	}
+	defer c.connMu.Unlock()
+	if c.bufferSize <= 0 || c.closed || op != ws.OpText {
+		return ErrNotConnected
+	}
+	if len(c.buffer) >= c.bufferSize {
+		c.buffer = c.buffer[1:]
+	}
+	c.buffer = append(c.buffer, data)
+	return nil
 }
 
 // Write writes data to the client
+// It returns ErrAccessDenied if the data is an event the client is not allowed to receive
 func (c *Client) Write(data []byte) error {
+	if err := c.acl().authorizeReceive(c, data); err != nil {
+		return err
+	}
 	//call send middlewares
 	for _, middleware := range c.sendMiddlewares {
 		data, _ = middleware(c, data)
 	}
-	return wsutil.WriteServerMessage(c.conn, ws.OpText, data)
+	return c.writeFrame(ws.OpText, data)
 }
 
 // WriteJSON writes JSON data to the client
@@ -113,20 +363,19 @@ func (c *Client) WriteJSON(data interface{}) error {
 	if err != nil {
 		return err
 	}
-	//call send middlewares
-	for _, middleware := range c.sendMiddlewares {
-		jsonData, _ = middleware(c, jsonData)
-	}
-	//write data to client
-	return wsutil.WriteServerMessage(c.conn, ws.OpText, jsonData)
+	return c.Write(jsonData)
 }
 
-// WriteEvent writes an event to the client as JSON
+// WriteEvent writes an event to the client as JSON using the envelope of the app (see Config.EventEnvelope)
 func (c *Client) WriteEvent(event Event) error {
-	return c.WriteJSON(event)
+	data, err := c.envelope().Marshal(event)
+	if err != nil {
+		return err
+	}
+	return c.Write(data)
 }
 
 // read reads data from the client
 func (c *Client) read() ([]byte, ws.OpCode, error) {
-	return wsutil.ReadClientData(c.conn)
+	return wsutil.ReadClientData(c.getConn())
 }
@@ -3,7 +3,6 @@ package groWs
 import (
 	"errors"
 	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
 )
 
 type ClientHandler struct {
@@ -12,7 +11,12 @@ type ClientHandler struct {
 	onDisconnect func(*Client) error
 	on           map[string]func(client *Client, data []byte) error
 	onEvent      map[string]func(client *Client, data interface{}) error
-	middlewares  []HandlerFunc
+	validators   map[string]Validator
+	// event middlewares by event pattern
+	eventMiddlewares map[string][]EventMiddleware
+	// middlewares attached to a single On or OnEvent registration
+	onMiddlewares      map[string][]ReceiveMiddleware
+	onEventMiddlewares map[string][]EventMiddleware
 }
 
 func NewClientHandler() ClientHandler {
@@ -21,6 +25,12 @@ func NewClientHandler() ClientHandler {
 		onConnect:    nil,
 		on:           make(map[string]func(*Client, []byte) error),
 		onEvent:      make(map[string]func(*Client, interface{}) error),
+		validators:   make(map[string]Validator),
+		// event middlewares by event pattern
+		eventMiddlewares: make(map[string][]EventMiddleware),
+		// middlewares attached to a single On or OnEvent registration
+		onMiddlewares:      make(map[string][]ReceiveMiddleware),
+		onEventMiddlewares: make(map[string][]EventMiddleware),
 	}
 }
 
@@ -35,13 +45,51 @@ func (ch *ClientHandler) OnDisconnect(f func(client *Client) error) {
 }
 
 // On sets the on function
-func (ch *ClientHandler) On(event string, f func(client *Client, data []byte) error) {
+// The middlewares are only called for this registration before f, they receive the raw message
+// and can modify it, returning an error stops the handling of the message
+func (ch *ClientHandler) On(event string, f func(client *Client, data []byte) error, middlewares ...ReceiveMiddleware) {
 	ch.on[event] = f
+	ch.onMiddlewares[event] = middlewares
 }
 
-// OnEvent sets the onEvent function
-func (ch *ClientHandler) OnEvent(event string, f func(client *Client, data interface{}) error) {
+// OnEvent sets the onEvent function for an event identifier or pattern (e.g. "chat.*" or "chat.**")
+// If multiple patterns match an incoming event, the most specific one is used (see event_pattern.go)
+// The middlewares are only called for this registration (after the middlewares added with Use)
+// before the data is validated and f is called, returning an error stops the handling of the event
+func (ch *ClientHandler) OnEvent(event string, f func(client *Client, data interface{}) error, middlewares ...EventMiddleware) {
 	ch.onEvent[event] = f
+	ch.onEventMiddlewares[event] = middlewares
+}
+
+// ValidateEvent sets a Validator for the event identifier or pattern
+// The data of incoming events is validated before the handler is called,
+// if it is invalid an error event (ErrorEventIdentifier) listing the violations is sent to the client instead
+func (ch *ClientHandler) ValidateEvent(event string, validator Validator) {
+	ch.validators[event] = validator
+}
+
+// Use adds middlewares that are only called for events matching the pattern (e.g. "admin.*")
+// Middlewares of all matching patterns are called from the least to the most specific pattern
+// before the data is validated and the handler is called
+func (ch *ClientHandler) Use(pattern string, middlewares ...EventMiddleware) {
+	ch.eventMiddlewares[pattern] = append(ch.eventMiddlewares[pattern], middlewares...)
+}
+
+// Mount adds all event handlers, validators and middlewares of sub to this handler
+// with their identifiers and patterns prefixed by the namespace
+// (e.g. mounting a sub handler with OnEvent("create", ...) to "chat" handles "chat.create")
+// A catch-all handler ("*") of sub handles all events in the namespace ("chat.**")
+// Raw message handlers and connection handlers of sub are not mounted
+func (ch *ClientHandler) Mount(namespace string, sub ClientHandler) {
+	for pattern, f := range sub.onEvent {
+		ch.OnEvent(namespaceEventPattern(namespace, pattern), f, sub.onEventMiddlewares[pattern]...)
+	}
+	for pattern, validator := range sub.validators {
+		ch.validators[namespaceEventPattern(namespace, pattern)] = validator
+	}
+	for pattern, middlewares := range sub.eventMiddlewares {
+		ch.Use(namespaceEventPattern(namespace, pattern), middlewares...)
+	}
 }
 
 // handle handles an incoming on
@@ -57,12 +105,16 @@ func (ch *ClientHandler) handle(data []byte, op ws.OpCode, c *Client) error {
 		}
 		return ch.onDisconnect(c)
 	case ws.OpText:
-		if IsJSONObject(data) && IsEvent(data) {
-			return ch.handleOnEvent(data, c)
+		event, err := c.envelope().Parse(data)
+		if errors.Is(err, ErrNotAnEvent) {
+			return ch.handleOn(data, c)
 		}
-		return ch.handleOn(data, c)
+		if err != nil {
+			return err
+		}
+		return ch.handleOnEvent(event, c)
 	case ws.OpPing:
-		return wsutil.WriteServerMessage(c.conn, ws.OpPong, data)
+		return c.writeFrame(ws.OpPong, data)
 	case ws.OpPong:
 		return nil
 
@@ -71,28 +123,56 @@ func (ch *ClientHandler) handle(data []byte, op ws.OpCode, c *Client) error {
 	}
 }
 
-// handleEvent handles an incoming event
-func (ch *ClientHandler) handleOnEvent(data []byte, c *Client) error {
-	event, err := FromJSON(data)
-	if err != nil {
+// handleOnEvent handles an incoming event
+func (ch *ClientHandler) handleOnEvent(event Event, c *Client) error {
+	if err := c.acl().authorizeOrReply(c, ActionEmit, event.Identifier); err != nil {
+		return nil
+	}
+	for _, pattern := range matchingEventPatterns(ch.eventMiddlewares, event.Identifier) {
+		if err := runEventMiddlewares(ch.eventMiddlewares[pattern], c, &event); err != nil {
+			return err
+		}
+	}
+	pattern, ok := bestEventPattern(ch.onEvent, event.Identifier)
+	if !ok {
+		return nil
+	}
+	if err := runEventMiddlewares(ch.onEventMiddlewares[pattern], c, &event); err != nil {
 		return err
 	}
-	if ch.onEvent[event.Identifier] == nil {
-		if ch.onEvent["*"] == nil {
-			return nil
+	if pattern, ok := bestEventPattern(ch.validators, event.Identifier); ok {
+		if violations := ch.validators[pattern].Validate(event.Data); len(violations) > 0 {
+			return c.WriteEvent(NewErrorEvent(ErrorCodeValidation, event.Identifier,
+				"invalid event data", violations))
 		}
-		return ch.onEvent["*"](c, event.Data)
 	}
-	return ch.onEvent[event.Identifier](c, event.Data)
+	return ch.onEvent[pattern](c, event.Data)
 }
 
 // handleOn handles an incoming on
 func (ch *ClientHandler) handleOn(data []byte, c *Client) error {
-	if ch.on[string(data)] == nil {
+	key := string(data)
+	if ch.on[key] == nil {
 		if ch.on["*"] == nil {
 			return nil
 		}
-		return ch.on["*"](c, data)
+		key = "*"
+	}
+	for _, middleware := range ch.onMiddlewares[key] {
+		var err error
+		if data, err = middleware(c, data); err != nil {
+			return err
+		}
+	}
+	return ch.on[key](c, data)
+}
+
+// runEventMiddlewares calls the middlewares in order and stops on the first error
+func runEventMiddlewares(middlewares []EventMiddleware, c *Client, event *Event) error {
+	for _, middleware := range middlewares {
+		if err := middleware(c, event); err != nil {
+			return err
+		}
 	}
-	return ch.on[string(data)](c, data)
+	return nil
 }
@@ -0,0 +1,140 @@
+package groWs
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMatchEventPattern(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		identifier string
+		want       bool
+	}{
+		{"chat.message.create", "chat.message.create", true},
+		{"chat.*", "chat.join", true},
+		{"chat.*", "chat.message.create", false},
+		{"chat.*", "chat", false},
+		{"chat.**", "chat.join", true},
+		{"chat.**", "chat.message.create", true},
+		{"chat.**", "chat", false},
+		{"chat.*.create", "chat.message.create", true},
+		{"chat.**.create", "chat.a.b.create", true},
+		{"chat.**.create", "chat.a.b.delete", false},
+		{"*", "anything.at.all", true},
+	}
+	for _, tt := range tests {
+		if got := matchEventPattern(tt.pattern, tt.identifier); got != tt.want {
+			t.Errorf("matchEventPattern(%q, %q) = %v, want %v", tt.pattern, tt.identifier, got, tt.want)
+		}
+	}
+}
+
+func TestClientHandlerEventRouting(t *testing.T) {
+	calls := make([]string, 0)
+	record := func(name string) func(*Client, interface{}) error {
+		return func(*Client, interface{}) error {
+			calls = append(calls, name)
+			return nil
+		}
+	}
+	chat := NewClientHandler()
+	chat.OnEvent("message.create", record("create"))
+	chat.OnEvent("*", record("chat-fallback"))
+
+	handler := NewClientHandler()
+	handler.OnEvent("*", record("fallback"))
+	handler.OnEvent("admin.*", record("admin"))
+	handler.Mount("chat", chat)
+
+	for _, identifier := range []string{"chat.message.create", "chat.join", "admin.kick", "other"} {
+		if err := handler.handleOnEvent(Event{Identifier: identifier}, &Client{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"create", "chat-fallback", "admin", "fallback"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("expected calls %v, got %v", want, calls)
+	}
+}
+
+func TestClientHandlerScopedMiddleware(t *testing.T) {
+	errDenied := errors.New("denied")
+	order := make([]string, 0)
+	handler := NewClientHandler()
+	handler.Use("admin.**", func(client *Client, event *Event) error {
+		order = append(order, "admin.**")
+		return nil
+	})
+	handler.Use("admin.kick", func(client *Client, event *Event) error {
+		order = append(order, "admin.kick")
+		return errDenied
+	})
+	handler.OnEvent("admin.*", func(client *Client, data interface{}) error {
+		order = append(order, "handler")
+		return nil
+	})
+	handler.OnEvent("chat", func(client *Client, data interface{}) error {
+		order = append(order, "chat")
+		return nil
+	})
+
+	if err := handler.handleOnEvent(Event{Identifier: "admin.kick"}, &Client{}); !errors.Is(err, errDenied) {
+		t.Errorf("expected middleware error, got %v", err)
+	}
+	if err := handler.handleOnEvent(Event{Identifier: "admin.list"}, &Client{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.handleOnEvent(Event{Identifier: "chat"}, &Client{}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"admin.**", "admin.kick", "admin.**", "handler", "chat"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("expected %v, got %v", want, order)
+	}
+}
+
+func TestClientHandlerRegistrationMiddleware(t *testing.T) {
+	seen := make([]Event, 0)
+	logEvent := func(client *Client, event *Event) error {
+		seen = append(seen, *event)
+		return nil
+	}
+	handler := NewClientHandler()
+	handler.OnEvent("chat.send", func(client *Client, data interface{}) error {
+		if data != "upper" {
+			t.Errorf("expected modified data, got %v", data)
+		}
+		return nil
+	}, logEvent, func(client *Client, event *Event) error {
+		event.Data = "upper"
+		return nil
+	})
+	handler.OnEvent("chat.other", func(client *Client, data interface{}) error { return nil })
+	handler.On("ping", func(client *Client, data []byte) error {
+		if string(data) != "pong" {
+			t.Errorf("expected modified message, got %s", data)
+		}
+		return nil
+	}, func(client *Client, data []byte) ([]byte, error) {
+		return []byte("pong"), nil
+	})
+	handler.On("drop", func(client *Client, data []byte) error {
+		t.Error("expected the middleware error to stop the handling")
+		return nil
+	}, func(client *Client, data []byte) ([]byte, error) {
+		return nil, ErrDropMessage
+	})
+
+	_ = handler.handleOnEvent(Event{Identifier: "chat.send", Data: "lower"}, &Client{})
+	_ = handler.handleOnEvent(Event{Identifier: "chat.other"}, &Client{})
+	_ = handler.handleOn([]byte("ping"), &Client{})
+	if err := handler.handleOn([]byte("drop"), &Client{}); !errors.Is(err, ErrDropMessage) {
+		t.Errorf("expected ErrDropMessage, got %v", err)
+	}
+
+	if len(seen) != 1 || seen[0].Identifier != "chat.send" || seen[0].Data != "lower" {
+		t.Errorf("unexpected events seen by middleware: %+v", seen)
+	}
+}
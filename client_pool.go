@@ -1,7 +1,9 @@
 package groWs
 
 import (
+	"errors"
 	"log"
+	"sort"
 	"sync"
 )
 
@@ -21,15 +23,24 @@ type ClientPool struct {
 	clients map[string]*Client
 	mu      sync.RWMutex
 	rooms   map[string]*Room
+	// users indexes clients by user ID and client ID
+	users map[string]map[string]*Client
+	// pending are the clients admitted (see admit) but not added yet
+	pending map[string]*Client
+	// watcher is notified about added clients and room memberships (e.g. to subscribe to room channels)
+	watcher poolWatcher
 }
 
 func newClientPool() *ClientPool {
 	return &ClientPool{
 		clients: make(map[string]*Client),
 		rooms:   make(map[string]*Room),
+		users:   make(map[string]map[string]*Client),
+		pending: make(map[string]*Client),
 	}
 }
 
+// GetClientPool returns the pool of the clients of the default app connected to this node
 func GetClientPool() *ClientPool {
 	if clientPool == nil {
 		clientPool = newClientPool()
@@ -37,18 +48,152 @@ func GetClientPool() *ClientPool {
 	return clientPool
 }
 
+// GetClientPool returns the pool of the clients of the app connected to this node
+func (a *App) GetClientPool() *ClientPool {
+	return a.pool
+}
+
 // AddClient adds a client to the pool
 func (cp *ClientPool) AddClient(c *Client) {
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
+	if cp.pending[c.GetID()] == c {
+		delete(cp.pending, c.GetID())
+	}
+	existing := cp.clients[c.GetID()]
+	if existing == c {
+		return
+	}
+	if existing != nil && cp.watcher != nil {
+		cp.watcher.clientRemoved(existing)
+	}
 	cp.clients[c.GetID()] = c
+	cp.addUserLocked(c, c.GetUserID())
+	if cp.watcher != nil {
+		cp.watcher.clientAdded(c)
+	}
 }
 
 // RemoveClient removes a client from the pool
+// A newer client with the same ID (see IDCollisionPolicy) is not removed
 func (cp *ClientPool) RemoveClient(c *Client) {
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
-	delete(cp.clients, c.GetID())
+	if cp.pending[c.GetID()] == c {
+		delete(cp.pending, c.GetID())
+	}
+	if cp.clients[c.GetID()] == c {
+		delete(cp.clients, c.GetID())
+		cp.removeUserLocked(c, c.GetUserID())
+		if cp.watcher != nil {
+			cp.watcher.clientRemoved(c)
+		}
+	}
+}
+
+// setWatcher sets the watcher of the pool and notifies it about the clients and rooms already in the pool
+func (cp *ClientPool) setWatcher(watcher poolWatcher) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.watcher = watcher
+	if watcher == nil {
+		return
+	}
+	for _, client := range cp.clients {
+		watcher.clientAdded(client)
+	}
+	for roomId, room := range cp.rooms {
+		room.mu.RLock()
+		for _, client := range room.clients {
+			watcher.roomJoined(client, roomId)
+		}
+		room.mu.RUnlock()
+	}
+}
+
+// getWatcher returns the watcher of the pool
+func (cp *ClientPool) getWatcher() poolWatcher {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	return cp.watcher
+}
+
+// reindexUser moves a pooled client from the previous to its current user ID
+func (cp *ClientPool) reindexUser(c *Client, previous string) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.clients[c.GetID()] != c {
+		return
+	}
+	cp.removeUserLocked(c, previous)
+	cp.addUserLocked(c, c.GetUserID())
+}
+
+// retenant notifies the watcher about the new tenant of a pooled client (e.g. to move its room subscriptions)
+func (cp *ClientPool) retenant(c *Client) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.clients[c.GetID()] != c || cp.watcher == nil {
+		return
+	}
+	cp.watcher.clientRemoved(c)
+	cp.watcher.clientAdded(c)
+	for roomId, room := range cp.rooms {
+		room.mu.RLock()
+		if room.clients[c.GetID()] == c {
+			cp.watcher.roomLeft(c, roomId)
+			cp.watcher.roomJoined(c, roomId)
+		}
+		room.mu.RUnlock()
+	}
+}
+
+// addUserLocked adds a client to the user index (mu must be held)
+func (cp *ClientPool) addUserLocked(c *Client, userID string) {
+	if userID == "" {
+		return
+	}
+	if cp.users[userID] == nil {
+		cp.users[userID] = make(map[string]*Client)
+	}
+	cp.users[userID][c.GetID()] = c
+}
+
+// removeUserLocked removes a client from the user index (mu must be held)
+func (cp *ClientPool) removeUserLocked(c *Client, userID string) {
+	if cp.users[userID][c.GetID()] != c {
+		return
+	}
+	delete(cp.users[userID], c.GetID())
+	if len(cp.users[userID]) == 0 {
+		delete(cp.users, userID)
+	}
+}
+
+// GetUserClients returns all clients of a user
+func (cp *ClientPool) GetUserClients(userID string) []*Client {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	clients := make([]*Client, 0, len(cp.users[userID]))
+	for _, client := range cp.users[userID] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// SendToUser sends a Message to all clients of a user
+func (cp *ClientPool) SendToUser(userID string, message []byte) {
+	writeClients(cp.GetUserClients(userID), message)
+}
+
+// DisconnectUser closes the connections of all clients of a user
+func (cp *ClientPool) DisconnectUser(userID string) {
+	for _, client := range cp.GetUserClients(userID) {
+		err := client.Close()
+		if err != nil {
+			log.Println(err)
+		}
+	}
 }
 
 // GetClient returns a client by Id
@@ -89,19 +234,24 @@ func (cp *ClientPool) AddClientToRoom(c *Client, roomId string) {
 	}
 	cp.rooms[roomId].mu.Lock()
 	defer cp.rooms[roomId].mu.Unlock()
+	existing := cp.rooms[roomId].clients[c.GetID()]
+	if existing == c {
+		return
+	}
+	if existing != nil && cp.watcher != nil {
+		cp.watcher.roomLeft(existing, roomId)
+	}
 	cp.rooms[roomId].clients[c.GetID()] = c
+	if cp.watcher != nil {
+		cp.watcher.roomJoined(c, roomId)
+	}
 }
 
 // RemoveClientFromRoom removes a client from a Id
 func (cp *ClientPool) RemoveClientFromRoom(c *Client, roomId string) {
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
-	cp.rooms[roomId].mu.Lock()
-	defer cp.rooms[roomId].mu.Unlock()
-	delete(cp.rooms[roomId].clients, c.GetID())
-	if len(cp.rooms[roomId].clients) == 0 {
-		delete(cp.rooms, roomId)
-	}
+	cp.removeClientFromRoom(c, roomId)
 }
 
 // RemoveClientFromAllRooms removes a client from all rooms
@@ -109,14 +259,28 @@ func (cp *ClientPool) RemoveClientFromAllRooms(c *Client, rooms []string) {
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
 	for _, roomId := range rooms {
-		cp.rooms[roomId].mu.Lock()
-		delete(cp.rooms[roomId].clients, c.GetID())
-		if len(cp.rooms[roomId].clients) == 0 {
-			delete(cp.rooms, roomId)
-		} else {
-			cp.rooms[roomId].mu.Unlock()
+		cp.removeClientFromRoom(c, roomId)
+	}
+}
+
+// removeClientFromRoom removes a client from a room and deletes empty rooms (cp.mu must be held)
+// A newer client with the same ID is not removed
+func (cp *ClientPool) removeClientFromRoom(c *Client, roomId string) {
+	room := cp.rooms[roomId]
+	if room == nil {
+		return
+	}
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if room.clients[c.GetID()] == c {
+		delete(room.clients, c.GetID())
+		if cp.watcher != nil {
+			cp.watcher.roomLeft(c, roomId)
 		}
 	}
+	if len(room.clients) == 0 {
+		delete(cp.rooms, roomId)
+	}
 }
 
 // GetRoom returns a room by identifier
@@ -136,60 +300,143 @@ func (cp *ClientPool) GetRooms() map[string]*Room {
 // SendToRoom sends a Message to all clients in a Id
 func (cp *ClientPool) SendToRoom(roomId string, message []byte) {
 	cp.mu.RLock()
-	defer cp.mu.RUnlock()
-	if cp.rooms[roomId] != nil {
-		cp.rooms[roomId].mu.RLock()
-		defer cp.rooms[roomId].mu.RUnlock()
-		for _, client := range cp.rooms[roomId].clients {
-			err := client.Write(message)
-			if err != nil {
-				log.Println(err) // TODO: handle error
-			}
+	clients := make([]*Client, 0)
+	if room := cp.rooms[roomId]; room != nil {
+		room.mu.RLock()
+		for _, client := range room.clients {
+			clients = append(clients, client)
 		}
+		room.mu.RUnlock()
 	}
+	cp.mu.RUnlock()
+	writeClients(clients, message)
 }
 
 // SendToAll sends a Message to all clients
 func (cp *ClientPool) SendToAll(message []byte) {
-	cp.mu.RLock()
-	defer cp.mu.RUnlock()
-	for _, client := range cp.clients {
-		client.Write(message)
-	}
+	writeClients(cp.selectClients(func(client *Client) bool { return true }), message)
 }
 
 // SendToAllExcept sends a Message to all clients except the client with the given identifier
 func (cp *ClientPool) SendToAllExcept(id string, message []byte) {
+	writeClients(cp.selectClients(func(client *Client) bool { return client.GetID() != id }), message)
+}
+
+// SendToAllByMeta sends a Message to all clients with a specific metadata
+func (cp *ClientPool) SendToAllByMeta(key string, value interface{}, message []byte) {
+	writeClients(cp.selectClients(func(client *Client) bool {
+		meta, _ := client.GetMeta(key)
+		return meta == value
+	}), message)
+}
+
+// SendToAllByFilter sends a Message to all clients matching the metadata filter
+func (cp *ClientPool) SendToAllByFilter(filter MetaFilter, message []byte) {
+	writeClients(cp.selectClients(filter.Matches), message)
+}
+
+// selectClients returns the clients matching the function
+// The clients are written after releasing the lock, so a slow client does not block the pool
+func (cp *ClientPool) selectClients(match func(client *Client) bool) []*Client {
 	cp.mu.RLock()
 	defer cp.mu.RUnlock()
+	clients := make([]*Client, 0)
 	for _, client := range cp.clients {
-		if client.GetID() != id {
-			client.Write(message)
+		if match(client) {
+			clients = append(clients, client)
 		}
 	}
+	return clients
 }
 
-// SendToAllByMeta sends a Message to all clients with a specific metadata
-func (cp *ClientPool) SendToAllByMeta(key string, value interface{}, message []byte) {
+// writeClients writes a broadcast message to the clients
+func writeClients(clients []*Client, message []byte) {
+	for _, client := range clients {
+		writeClient(client, message)
+	}
+}
+
+// writeClient writes a broadcast message to a client and logs failed writes
+// Messages the ACL does not allow the client to receive are reported to the OnDenied hook of the ACL.
+func writeClient(client *Client, message []byte) {
+	if err := client.Write(message); err != nil && !errors.Is(err, ErrAccessDenied) {
+		log.Println(err)
+	}
+}
+
+// presence returns the clients of the pool with their rooms
+func (cp *ClientPool) presence(node string) []PresenceClient {
 	cp.mu.RLock()
 	defer cp.mu.RUnlock()
-	for _, client := range cp.clients {
-		if client.meta[key] == value {
-			client.Write(message)
+	clients := make(map[string]*PresenceClient, len(cp.clients))
+	for id, client := range cp.clients {
+		clients[id] = &PresenceClient{ID: id, UserID: client.GetUserID(), Tenant: client.GetTenant(), Node: node}
+	}
+	for roomId, room := range cp.rooms {
+		room.mu.RLock()
+		for id, client := range room.clients {
+			if presence := clients[id]; presence != nil && cp.clients[id] == client {
+				presence.Rooms = append(presence.Rooms, roomId)
+			}
 		}
+		room.mu.RUnlock()
 	}
+	presence := make([]PresenceClient, 0, len(clients))
+	for _, client := range clients {
+		sort.Strings(client.Rooms)
+		presence = append(presence, *client)
+	}
+	return presence
 }
 
-// SendToClient sends a Message to a client with the given Id
-func (cp *ClientPool) SendToClient(id string, message []byte) error {
+// recipients returns the clients of the pool addressed by the pub/sub payload
+// Only clients of the tenant of the payload are returned
+func (cp *ClientPool) recipients(payload Payload) []*Client {
 	cp.mu.RLock()
 	defer cp.mu.RUnlock()
-	if client, ok := cp.clients[id]; ok {
-		err := client.Write(message)
-		if err != nil {
-
-			return err
+	clients := make([]*Client, 0)
+	add := func(client *Client) {
+		if client.GetTenant() == payload.Tenant {
+			clients = append(clients, client)
 		}
 	}
+	switch payload.Kind {
+	case PayloadClient, PayloadControl:
+		if client := cp.clients[payload.Id]; client != nil {
+			add(client)
+		}
+	case PayloadRoom:
+		if room := cp.rooms[payload.Id]; room != nil {
+			room.mu.RLock()
+			for _, client := range room.clients {
+				add(client)
+			}
+			room.mu.RUnlock()
+		}
+	case PayloadAll:
+		for id, client := range cp.clients {
+			if id != payload.Except {
+				add(client)
+			}
+		}
+	case PayloadUser, PayloadDisconnectUser:
+		for _, client := range cp.users[payload.Id] {
+			add(client)
+		}
+	case PayloadMeta:
+		for _, client := range cp.clients {
+			if payload.Filter.Matches(client) {
+				add(client)
+			}
+		}
+	}
+	return clients
+}
+
+// SendToClient sends a Message to a client with the given Id
+func (cp *ClientPool) SendToClient(id string, message []byte) error {
+	if client := cp.GetClient(id); client != nil {
+		return client.Write(message)
+	}
 	return nil
 }
@@ -0,0 +1,165 @@
+package groWs
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestClient(id string, route string, meta map[string]interface{}, connectedAt time.Time) *Client {
+	client := &Client{id: id, route: route, meta: meta, connectedAt: connectedAt}
+	if client.meta == nil {
+		client.meta = make(map[string]interface{})
+	}
+	return client
+}
+
+func TestClientPoolAdmit(t *testing.T) {
+	pool := newClientPool()
+	now := time.Now()
+	pool.AddClient(newTestClient("a", "/chat", map[string]interface{}{"UserID": "u1"}, now.Add(-3*time.Minute)))
+	pool.AddClient(newTestClient("b", "/chat", map[string]interface{}{"UserID": "u1"}, now.Add(-2*time.Minute)))
+	pool.AddClient(newTestClient("c", "/other", map[string]interface{}{"UserID": "u1"}, now.Add(-time.Minute)))
+
+	user := newTestClient("d", "/chat", map[string]interface{}{"UserID": "u1"}, now)
+	reject := ConnectionLimits{MetaKey: "UserID", MaxPerMeta: 2}
+	if _, _, err := pool.admit(user, CollisionReject, connectionLimitsFor(user, 0, LimitReject, reject)); !errors.Is(err, ErrConnectionLimit) {
+		t.Errorf("expected ErrConnectionLimit, got %v", err)
+	}
+
+	evict := ConnectionLimits{MetaKey: "UserID", MaxPerMeta: 2, Policy: LimitEvictOldest}
+	_, evicted, err := pool.admit(user, CollisionReject, connectionLimitsFor(user, 0, LimitReject, evict))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evicted) != 1 || evicted[0].GetID() != "a" || pool.GetClient("a") != nil {
+		t.Errorf("expected the oldest client of the route to be evicted, got %v", evicted)
+	}
+
+	if _, _, err := pool.admit(user, CollisionReject, connectionLimitsFor(user, 2, LimitReject, ConnectionLimits{})); !errors.Is(err, ErrConnectionLimit) {
+		t.Errorf("expected global limit to reject, got %v", err)
+	}
+	if _, _, err := pool.admit(user, CollisionReject, connectionLimitsFor(user, 3, LimitReject, ConnectionLimits{})); err != nil {
+		t.Errorf("expected connection to be admitted, got %v", err)
+	}
+}
+
+func TestClientPoolIDCollision(t *testing.T) {
+	pool := newClientPool()
+	old := newTestClient("user-1", "/chat", nil, time.Now())
+	pool.AddClient(old)
+	pool.AddClientToRoom(old, "room")
+
+	client := newTestClient("user-1", "/chat", nil, time.Now())
+	if _, _, err := pool.admit(client, CollisionReject, nil); !errors.Is(err, ErrIDConflict) {
+		t.Errorf("expected ErrIDConflict, got %v", err)
+	}
+	replaced, _, err := pool.admit(client, CollisionReplace, nil)
+	if err != nil || replaced != old {
+		t.Fatalf("expected old client to be replaced, got %v, %v", replaced, err)
+	}
+	// the ID is claimed until the client is added, a concurrent handshake with the same ID is rejected
+	concurrent := newTestClient("user-1", "/chat", nil, time.Now())
+	if _, _, err := pool.admit(concurrent, CollisionReplace, nil); !errors.Is(err, ErrIDConflict) {
+		t.Errorf("expected ErrIDConflict for a connecting ID, got %v", err)
+	}
+
+	pool.AddClient(client)
+	pool.AddClientToRoom(client, "room")
+	// cleanup of the replaced client must not remove the new one
+	pool.RemoveClient(old)
+	pool.RemoveClientFromAllRooms(old, []string{"room", "unknown"})
+	if pool.GetClient("user-1") != client || pool.GetRoom("room") == nil {
+		t.Error("new client was removed by the cleanup of the replaced client")
+	}
+	if _, _, err := pool.admit(concurrent, CollisionReject, nil); !errors.Is(err, ErrIDConflict) {
+		t.Errorf("expected ErrIDConflict after the client was added, got %v", err)
+	}
+}
+
+func TestClientPoolUserIndex(t *testing.T) {
+	pool := newClientPool()
+	tab, phone, other := newTestClient("tab", "/", nil, time.Now()),
+		newTestClient("phone", "/", nil, time.Now()),
+		newTestClient("other", "/", nil, time.Now())
+	tab.userID, phone.userID, other.userID = "alice", "alice", "bob"
+	pool.AddClient(tab)
+	pool.AddClient(phone)
+	pool.AddClient(other)
+
+	if clients := pool.GetUserClients("alice"); len(clients) != 2 {
+		t.Errorf("expected 2 clients of alice, got %d", len(clients))
+	}
+	pool.RemoveClient(tab)
+	if clients := pool.GetUserClients("alice"); len(clients) != 1 || clients[0] != phone {
+		t.Errorf("expected only phone left, got %v", clients)
+	}
+	pool.RemoveClient(phone)
+	if _, ok := pool.users["alice"]; ok {
+		t.Error("expected empty user entry to be deleted")
+	}
+}
+
+func TestClientPoolAdmitReservation(t *testing.T) {
+	pool := newClientPool()
+	first, second := newTestClient("a", "/chat", nil, time.Now()), newTestClient("b", "/chat", nil, time.Now())
+	limits := ConnectionLimits{MaxConnections: 1}
+	if _, _, err := pool.admit(first, CollisionReject, connectionLimitsFor(first, 0, LimitReject, limits)); err != nil {
+		t.Fatal(err)
+	}
+	// the first client is still upgrading, its slot is reserved
+	if _, _, err := pool.admit(second, CollisionReject, connectionLimitsFor(second, 0, LimitReject, limits)); !errors.Is(err, ErrConnectionLimit) {
+		t.Errorf("expected reserved slot to count towards the limit, got %v", err)
+	}
+	evict := ConnectionLimits{MaxConnections: 1, Policy: LimitEvictOldest}
+	if _, _, err := pool.admit(second, CollisionReject, connectionLimitsFor(second, 0, LimitReject, evict)); !errors.Is(err, ErrConnectionLimit) {
+		t.Errorf("expected reserved client not to be evicted, got %v", err)
+	}
+	pool.release(first)
+	if _, _, err := pool.admit(second, CollisionReject, connectionLimitsFor(second, 0, LimitReject, limits)); err != nil {
+		t.Errorf("expected released slot to be available, got %v", err)
+	}
+	pool.AddClient(second)
+	if len(pool.pending) != 0 {
+		t.Errorf("expected reservation to be removed when the client is added, got %d", len(pool.pending))
+	}
+}
+
+func TestClientPoolStalledClient(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	app := &App{config: Config{WriteTimeout: 200 * time.Millisecond}, pool: newClientPool()}
+	stalled := newTestClient("stalled", "/", nil, time.Now())
+	stalled.app = app
+	stalled.setConn(conn)
+	app.pool.AddClient(stalled)
+
+	// nobody reads from the peer, so the write blocks until the write timeout
+	sent := make(chan struct{})
+	go func() {
+		app.pool.SendToAll([]byte("hi"))
+		close(sent)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	unblocked := make(chan struct{})
+	go func() {
+		app.pool.AddClient(newTestClient("other", "/", nil, time.Now()))
+		_ = stalled.isClosed()
+		_ = stalled.getConn()
+		close(unblocked)
+	}()
+	select {
+	case <-unblocked:
+	case <-sent:
+		t.Fatal("expected the pool and the client state not to wait for the stalled write")
+	}
+	select {
+	case <-sent:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the write to time out")
+	}
+	if err := stalled.Write([]byte("hi")); err == nil {
+		t.Error("expected the connection of the stalled client to be closed")
+	}
+}
@@ -0,0 +1,147 @@
+package groWs
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrConnectionLimit is returned if a new connection exceeds a connection limit
+var ErrConnectionLimit = errors.New("connection limit reached")
+
+// ErrorCodeEvicted is used in the error event sent to a client closed to make room for a new connection
+const ErrorCodeEvicted = "evicted"
+
+// LimitPolicy defines what happens to a new connection if a connection limit is reached
+type LimitPolicy int
+
+const (
+	// LimitReject refuses the websocket upgrade with 503 Service Unavailable
+	LimitReject LimitPolicy = iota
+	// LimitEvictOldest accepts the connection and closes the oldest connection of the limited group
+	LimitEvictOldest
+)
+
+// ConnectionLimits caps the concurrent connections of a route (a zero value means unlimited)
+type ConnectionLimits struct {
+	// MaxConnections caps the connections of the route
+	MaxConnections int `json:"max_connections"`
+	// MaxPerMeta caps the connections of the route with the same value of the MetaKey metadata
+	// (e.g. 5 tabs per user with MetaKey "UserID"), the metadata has to be set by a HandshakeMiddleware
+	MetaKey    string `json:"meta_key"`
+	MaxPerMeta int    `json:"max_per_meta"`
+	// Policy applied if a limit of the route is reached
+	Policy LimitPolicy `json:"policy"`
+}
+
+// connectionLimit is a single limit checked by ClientPool.admit
+type connectionLimit struct {
+	max    int
+	policy LimitPolicy
+	// member reports if a client counts towards the limit
+	member func(client *Client) bool
+}
+
+// connectionLimitsFor returns the limits a new client has to satisfy
+func connectionLimitsFor(client *Client, maxConnections int, policy LimitPolicy, limits ConnectionLimits) []connectionLimit {
+	result := make([]connectionLimit, 0, 3)
+	if maxConnections > 0 {
+		result = append(result, connectionLimit{
+			max:    maxConnections,
+			policy: policy,
+			member: func(*Client) bool { return true },
+		})
+	}
+	if limits.MaxConnections > 0 {
+		result = append(result, connectionLimit{
+			max:    limits.MaxConnections,
+			policy: limits.Policy,
+			member: func(c *Client) bool { return c.route == client.route },
+		})
+	}
+	if limits.MaxPerMeta > 0 && limits.MetaKey != "" {
+		if value, err := client.GetMeta(limits.MetaKey); err == nil {
+			result = append(result, connectionLimit{
+				max:    limits.MaxPerMeta,
+				policy: limits.Policy,
+				member: func(c *Client) bool {
+					other, err := c.GetMeta(limits.MetaKey)
+					return c.route == client.route && err == nil && other == value
+				},
+			})
+		}
+	}
+	return result
+}
+
+// admit claims the ID of a new client, checks the limits and reserves a slot for it until it is added to the pool
+// Reserved clients hold their ID and count towards the limits of other new clients,
+// so concurrent handshakes cannot use the same ID or exceed the limits.
+// It returns the client to replace (see IDCollisionPolicy) and the clients that have to be evicted to make room for it,
+// the evicted clients are removed from the pool immediately.
+// The reservation has to be released with release if the client is not added (e.g. the upgrade failed).
+func (cp *ClientPool) admit(c *Client, policy IDCollisionPolicy, limits []connectionLimit) (*Client, []*Client, error) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	id := c.GetID()
+	if pending := cp.pending[id]; pending != nil && pending != c {
+		// another connection with the ID is being established
+		return nil, nil, ErrIDConflict
+	}
+	replaced := cp.clients[id]
+	if replaced == c {
+		replaced = nil
+	}
+	if replaced != nil && policy != CollisionReplace {
+		return nil, nil, ErrIDConflict
+	}
+	evict := make(map[string]*Client)
+	for _, limit := range limits {
+		members := make([]*Client, 0)
+		evictable := make([]*Client, 0)
+		for id, client := range cp.clients {
+			if evict[id] == nil && client != replaced && limit.member(client) {
+				members = append(members, client)
+				evictable = append(evictable, client)
+			}
+		}
+		for _, client := range cp.pending {
+			if client != c && limit.member(client) {
+				members = append(members, client)
+			}
+		}
+		if len(members) < limit.max {
+			continue
+		}
+		// reserved clients are not connected yet and cannot be evicted
+		excess := len(members) - limit.max + 1
+		if limit.policy != LimitEvictOldest || len(evictable) < excess {
+			return nil, nil, ErrConnectionLimit
+		}
+		sort.Slice(evictable, func(i, j int) bool {
+			return evictable[i].connectedAt.Before(evictable[j].connectedAt)
+		})
+		for _, client := range evictable[:excess] {
+			evict[client.GetID()] = client
+		}
+	}
+	evicted := make([]*Client, 0, len(evict))
+	for id, client := range evict {
+		delete(cp.clients, id)
+		cp.removeUserLocked(client, client.GetUserID())
+		if cp.watcher != nil {
+			cp.watcher.clientRemoved(client)
+		}
+		evicted = append(evicted, client)
+	}
+	cp.pending[id] = c
+	return replaced, evicted, nil
+}
+
+// release removes the reservation of a client admitted but not added to the pool
+func (cp *ClientPool) release(c *Client) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.pending[c.GetID()] == c {
+		delete(cp.pending, c.GetID())
+	}
+}
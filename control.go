@@ -0,0 +1,111 @@
+package groWs
+
+import (
+	json2 "encoding/json"
+	"log"
+)
+
+// Control commands executed by the node holding the connection of a client (see Namespace.Disconnect)
+const (
+	// CommandDisconnect closes the connection of the client
+	CommandDisconnect = "disconnect"
+	// CommandJoinRoom adds the client to the room
+	CommandJoinRoom = "join_room"
+	// CommandLeaveRoom removes the client from the room
+	CommandLeaveRoom = "leave_room"
+	// CommandSetMeta sets metadata of the client
+	CommandSetMeta = "set_meta"
+)
+
+// ControlCommand is the message of a PayloadControl
+// Services without App (see package publisher) publish it to execute commands for the clients of the nodes.
+type ControlCommand struct {
+	Command string           `json:"command"`
+	Room    string           `json:"room,omitempty"`
+	Key     string           `json:"key,omitempty"`
+	Value   json2.RawMessage `json:"value,omitempty"`
+}
+
+// sendCommand publishes the command to the node holding the connection of the client
+func (n Namespace) sendCommand(id string, command ControlCommand) error {
+	json, err := json2.Marshal(command)
+	if err != nil {
+		return err
+	}
+	return n.publish(Payload{Kind: PayloadControl, Id: id, Message: json})
+}
+
+// Disconnect closes the connection of the client, regardless of the node it is connected to
+func (n Namespace) Disconnect(id string) error {
+	return n.sendCommand(id, ControlCommand{Command: CommandDisconnect})
+}
+
+// JoinRoom adds the client to the room, regardless of the node it is connected to
+// The command is sent by the server, so the ACL is not checked.
+func (n Namespace) JoinRoom(id string, roomId string) error {
+	return n.sendCommand(id, ControlCommand{Command: CommandJoinRoom, Room: roomId})
+}
+
+// LeaveRoom removes the client from the room, regardless of the node it is connected to
+func (n Namespace) LeaveRoom(id string, roomId string) error {
+	return n.sendCommand(id, ControlCommand{Command: CommandLeaveRoom, Room: roomId})
+}
+
+// SetMeta sets metadata of the client, regardless of the node it is connected to
+// The value is sent as JSON, so the client gets the decoded value (e.g. numbers are float64).
+func (n Namespace) SetMeta(id string, key string, value interface{}) error {
+	json, err := json2.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return n.sendCommand(id, ControlCommand{Command: CommandSetMeta, Key: key, Value: json})
+}
+
+// Disconnect closes the connection of the client, regardless of the node it is connected to
+func Disconnect(id string) error {
+	return defaultNamespace.Disconnect(id)
+}
+
+// JoinRoom adds the client to the room, regardless of the node it is connected to
+func JoinRoom(id string, roomId string) error {
+	return defaultNamespace.JoinRoom(id, roomId)
+}
+
+// LeaveRoom removes the client from the room, regardless of the node it is connected to
+func LeaveRoom(id string, roomId string) error {
+	return defaultNamespace.LeaveRoom(id, roomId)
+}
+
+// SetMeta sets metadata of the client, regardless of the node it is connected to
+func SetMeta(id string, key string, value interface{}) error {
+	return defaultNamespace.SetMeta(id, key, value)
+}
+
+// execute runs the control command of the payload for a client of this node
+func (c *pubSubClient) execute(client *Client, message []byte) error {
+	command := ControlCommand{}
+	if err := json2.Unmarshal(message, &command); err != nil {
+		return err
+	}
+	switch command.Command {
+	case CommandDisconnect:
+		return client.Close()
+	case CommandJoinRoom:
+		if !containsString(client.GetRooms(), command.Room) {
+			c.pool.AddClientToRoom(client, command.Room)
+			client.joinRoom(command.Room)
+		}
+	case CommandLeaveRoom:
+		c.pool.RemoveClientFromRoom(client, command.Room)
+		client.leaveRoom(command.Room)
+	case CommandSetMeta:
+		var value interface{}
+		if err := json2.Unmarshal(command.Value, &value); err != nil {
+			return err
+		}
+		client.SetMeta(command.Key, value)
+	default:
+		log.Println("unknown control command: " + command.Command)
+	}
+	return nil
+}
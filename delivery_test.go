@@ -0,0 +1,558 @@
+package groWs
+
+import (
+	"context"
+	"github.com/gobwas/ws/wsutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNode is a node of a test cluster with its own client pool
+type testNode struct {
+	app     *App
+	pool    *ClientPool
+	pubsub  *pubSubClient
+	clients map[string]*Client
+}
+
+// addClient connects a buffering test client to the node
+func (n *testNode) addClient(id string, userID string, rooms ...string) {
+	client := newTestClient(id, "/", nil, time.Now())
+	client.bufferSize = 100
+	client.userID = userID
+	client.app = n.app
+	n.pool.AddClient(client)
+	for _, room := range rooms {
+		n.pool.AddClientToRoom(client, room)
+		client.joinRoom(room)
+	}
+	n.clients[id] = client
+	n.pubsub.subscriptions.flush()
+}
+
+// setTenant sets the tenant of a client of the node
+func (n *testNode) setTenant(id string, tenant string) {
+	n.clients[id].SetTenant(tenant)
+	n.pubsub.subscriptions.flush()
+}
+
+// initPubSubClient makes a client of the global pool using the config the default, like NewApp
+// The replaced default client is stopped.
+func initPubSubClient(ctx context.Context, config Config) error {
+	client, err := newPubSubClient(ctx, GetClientPool(), config)
+	if err != nil {
+		return err
+	}
+	pubSubMu.Lock()
+	defer pubSubMu.Unlock()
+	if pubSubClientInternal != nil {
+		pubSubClientInternal.stop()
+	}
+	pubSubClientInternal = client
+	return nil
+}
+
+// newTestCluster starts nodes sharing a MemoryBroker, the first node is the one used by the package functions
+func newTestCluster(t *testing.T, nodes int) []*testNode {
+	return newTestClusterWithConfig(t, nodes, Config{})
+}
+
+// newTestClusterWithConfig starts nodes with the config sharing a MemoryBroker
+func newTestClusterWithConfig(t *testing.T, nodes int, config Config) []*testNode {
+	config.Broker = NewMemoryBroker()
+	config.NodeID = "node-0"
+	clientPool = newClientPool()
+	if err := initPubSubClient(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	pubsub, _ := getPubSubClient()
+	cluster := []*testNode{{app: &App{config: config, pool: pubsub.pool, pubsub: pubsub}, pool: pubsub.pool, pubsub: pubsub,
+		clients: map[string]*Client{}}}
+	for i := 1; i < nodes; i++ {
+		pool := newClientPool()
+		config.NodeID = "node-" + strconv.Itoa(i)
+		pubsub, err := newPubSubClient(context.Background(), pool, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(pubsub.cancel)
+		app := &App{config: config, pool: pool, pubsub: pubsub}
+		cluster = append(cluster, &testNode{app: app, pool: pool, pubsub: pubsub, clients: map[string]*Client{}})
+	}
+	t.Cleanup(func() { clientPool = newClientPool() })
+	return cluster
+}
+
+// received returns the sorted IDs of the clients that received a message and clears their buffers
+func received(cluster []*testNode) []string {
+	ids := make([]string, 0)
+	for _, node := range cluster {
+		for id, client := range node.clients {
+			if len(client.buffer) > 0 || client.isClosed() {
+				ids = append(ids, id)
+			}
+			client.buffer = nil
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestDeliverySemantics(t *testing.T) {
+	event := Event{Identifier: "order.updated", Data: "42"}
+	tests := []struct {
+		name string
+		send func() error
+		want []string
+	}{
+		{"Broadcast", func() error { return Broadcast("r", []byte("hi")) }, []string{"a1", "b1", "c1"}},
+		{"BroadcastToAll", func() error { return BroadcastToAll([]byte("hi")) }, []string{"a1", "a2", "b1", "b2", "c1"}},
+		{"BroadcastEvent", func() error { return BroadcastEvent("r", event) }, []string{"a1", "b1", "c1"}},
+		{"BroadcastEventToAll", func() error { return BroadcastEventToAll(event) }, []string{"a1", "a2", "b1", "b2", "c1"}},
+		{"BroadcastExcept", func() error { return BroadcastExcept("b1", []byte("hi")) }, []string{"a1", "a2", "b2", "c1"}},
+		{"BroadcastEventExcept", func() error { return BroadcastEventExcept("a1", event) }, []string{"a2", "b1", "b2", "c1"}},
+		{"BroadcastToClient", func() error { return BroadcastToClient("b2", []byte("hi")) }, []string{"b2"}},
+		{"BroadcastEventToClient", func() error { return BroadcastEventToClient("c1", event) }, []string{"c1"}},
+		{"SendToUser", func() error { return SendToUser("u", []byte("hi")) }, []string{"a1", "b1"}},
+		{"SendEventToUser", func() error { return SendEventToUser("u", event) }, []string{"a1", "b1"}},
+		{"DisconnectUser", func() error { return DisconnectUser("u") }, []string{"a1", "b1"}},
+	}
+	// the same helpers must reach the same clients on a single node and in a cluster
+	for _, nodes := range []int{1, 3} {
+		for _, tt := range tests {
+			cluster := newTestCluster(t, nodes)
+			cluster[0].addClient("a1", "u", "r")
+			cluster[0].addClient("a2", "")
+			if nodes > 1 {
+				cluster[1].addClient("b1", "u", "r")
+				cluster[1].addClient("b2", "")
+				cluster[2].addClient("c1", "", "r")
+			}
+			if err := tt.send(); err != nil {
+				t.Fatalf("%s (%d nodes): %v", tt.name, nodes, err)
+			}
+			want := make([]string, 0)
+			for _, id := range tt.want {
+				if nodes > 1 || strings.HasPrefix(id, "a") {
+					want = append(want, id)
+				}
+			}
+			if got := received(cluster); strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("%s (%d nodes): delivered to %v, want %v", tt.name, nodes, got, want)
+			}
+		}
+	}
+}
+
+func TestDeliveryFromOtherNode(t *testing.T) {
+	cluster := newTestCluster(t, 2)
+	cluster[0].addClient("a1", "", "r")
+	cluster[1].addClient("b1", "", "r")
+	data, _ := Event{Identifier: "chat", Data: "hi"}.ToJSON()
+	if err := cluster[1].pubsub.publish(Payload{Kind: PayloadRoom, Id: "r", Message: data}); err != nil {
+		t.Fatal(err)
+	}
+	client := cluster[0].clients["a1"]
+	if len(client.buffer) != 1 || string(client.buffer[0]) != string(data) {
+		t.Fatalf("expected event %s on node 0, got %q", data, client.buffer)
+	}
+	if got := received(cluster); strings.Join(got, ",") != "a1,b1" {
+		t.Fatalf("delivered to %v", got)
+	}
+}
+
+func TestDeliveryByMetaFilter(t *testing.T) {
+	cluster := newTestCluster(t, 2)
+	cluster[0].addClient("a1", "")
+	cluster[0].addClient("a2", "")
+	cluster[1].addClient("b1", "")
+	cluster[1].addClient("b2", "")
+	cluster[0].clients["a1"].SetMeta("Tenant", "x")
+	cluster[0].clients["a1"].SetMeta("Role", "admin")
+	cluster[0].clients["a2"].SetMeta("Tenant", "y")
+	cluster[0].clients["a2"].SetMeta("Role", "admin")
+	cluster[1].clients["b1"].SetMeta("Tenant", "x")
+	cluster[1].clients["b1"].SetMeta("Role", "owner")
+	cluster[1].clients["b2"].SetMeta("Tenant", "x")
+
+	filter := MetaFilter{MetaEquals("Tenant", "x"), MetaIn("Role", "admin", "owner")}
+	if err := BroadcastEventByFilter(filter, Event{Identifier: "alert", Data: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := received(cluster); strings.Join(got, ",") != "a1,b1" {
+		t.Fatalf("BroadcastEventByFilter delivered to %v", got)
+	}
+	if err := BroadcastByMeta("Tenant", "x", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if got := received(cluster); strings.Join(got, ",") != "a1,b1,b2" {
+		t.Fatalf("BroadcastByMeta delivered to %v", got)
+	}
+}
+
+func TestDeliveryTenantIsolation(t *testing.T) {
+	cluster := newTestCluster(t, 2)
+	cluster[0].addClient("a1", "u", "r")
+	cluster[0].addClient("a2", "u", "r")
+	cluster[1].addClient("b1", "u", "r")
+	cluster[1].addClient("b2", "u", "r")
+	cluster[0].setTenant("a1", "x")
+	cluster[1].setTenant("b1", "x")
+	cluster[1].setTenant("b2", "y")
+
+	sends := []struct {
+		name string
+		send func() error
+		want string
+	}{
+		{"Tenant(x).BroadcastEvent", func() error { return Tenant("x").BroadcastEvent("r", Event{Identifier: "e"}) }, "a1,b1"},
+		{"Tenant(y).BroadcastToAll", func() error { return Tenant("y").BroadcastToAll([]byte("hi")) }, "b2"},
+		{"Tenant(x).SendToUser", func() error { return Tenant("x").SendToUser("u", []byte("hi")) }, "a1,b1"},
+		{"Tenant(y).BroadcastToClient", func() error { return Tenant("y").BroadcastToClient("a1", []byte("hi")) }, ""},
+		{"BroadcastToAll", func() error { return BroadcastToAll([]byte("hi")) }, "a2"},
+	}
+	for _, tt := range sends {
+		if err := tt.send(); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(received(cluster), ","); got != tt.want {
+			t.Errorf("%s: delivered to %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestChannelPrefix(t *testing.T) {
+	broker := NewMemoryBroker()
+	channels := make([]string, 0)
+	_, _ = broker.Subscribe(context.Background(), func(channel string, payload []byte) {
+		channels = append(channels, channel)
+	}, "app1:*")
+	pubsub, err := newPubSubClient(context.Background(), newClientPool(), Config{Broker: broker, ChannelPrefix: "app1", NodeID: "app1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pubsub.cancel()
+	_ = pubsub.publish(Payload{Kind: PayloadRoom, Id: "r"})
+	_ = pubsub.publish(Payload{Kind: PayloadAll, Tenant: "x"})
+	if strings.Join(channels, ",") != "app1:room:r,app1:tenant:x:all:clients" {
+		t.Fatalf("unexpected channels: %v", channels)
+	}
+}
+
+// subscribed returns the room and tenant channels the node is subscribed to
+func (n *testNode) subscribed() string {
+	n.pubsub.subscriptions.flush()
+	n.pubsub.subscriptions.mu.Lock()
+	defer n.pubsub.subscriptions.mu.Unlock()
+	channels := make([]string, 0, len(n.pubsub.subscriptions.refs))
+	for channel := range n.pubsub.subscriptions.refs {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return strings.Join(channels, ",")
+}
+
+func TestRoomSubscriptions(t *testing.T) {
+	cluster := newTestCluster(t, 2)
+	cluster[0].addClient("a1", "", "r1", "r2")
+	cluster[0].addClient("a2", "", "r1")
+	cluster[1].addClient("b1", "", "r2")
+	if got := cluster[0].subscribed(); got != "grows:room:r1,grows:room:r2" {
+		t.Fatalf("node 0 subscribed to %q", got)
+	}
+	if got := cluster[1].subscribed(); got != "grows:room:r2" {
+		t.Fatalf("node 1 subscribed to %q", got)
+	}
+
+	// the channel is kept until the last local client leaves the room
+	cluster[0].pool.RemoveClientFromRoom(cluster[0].clients["a1"], "r1")
+	if got := cluster[0].subscribed(); got != "grows:room:r1,grows:room:r2" {
+		t.Fatalf("node 0 subscribed to %q after a1 left r1", got)
+	}
+	cluster[0].pool.RemoveClientFromRoom(cluster[0].clients["a2"], "r1")
+	if got := cluster[0].subscribed(); got != "grows:room:r2" {
+		t.Fatalf("node 0 subscribed to %q after r1 became empty", got)
+	}
+
+	// messages to rooms without local clients are not received by the node
+	if err := Broadcast("r1", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Broadcast("r2", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if cluster[1].pubsub.subscriptions.subscription.(*memorySubscription).matches("grows:room:r1") {
+		t.Error("expected node 1 not to receive the messages of r1")
+	}
+	if got := strings.Join(received(cluster), ","); got != "a1,b1" {
+		t.Errorf("delivered to %q", got)
+	}
+
+	// tenant clients subscribe to the channels of their namespace
+	cluster[1].setTenant("b1", "x")
+	if got := cluster[1].subscribed(); got != "grows:tenant:x:all:clients,grows:tenant:x:client,grows:tenant:x:control,grows:tenant:x:room:r2,grows:tenant:x:user,grows:tenant:x:user:disconnect" {
+		t.Fatalf("node 1 subscribed to %q after setting the tenant", got)
+	}
+	cluster[1].pool.RemoveClient(cluster[1].clients["b1"])
+	cluster[1].pool.RemoveClientFromAllRooms(cluster[1].clients["b1"], []string{"r2"})
+	if got := cluster[1].subscribed(); got != "" {
+		t.Fatalf("node 1 subscribed to %q after the client left", got)
+	}
+}
+
+// blockingSubscription blocks Subscribe until unblocked
+type blockingSubscription struct {
+	Subscription
+	unblock chan struct{}
+}
+
+func (s *blockingSubscription) Subscribe(ctx context.Context, channels ...string) error {
+	<-s.unblock
+	return s.Subscription.Subscribe(ctx, channels...)
+}
+
+func TestSubscriptionsDoNotBlockPool(t *testing.T) {
+	cluster := newTestCluster(t, 2)
+	subscriptions := cluster[1].pubsub.subscriptions
+	blocking := &blockingSubscription{Subscription: subscriptions.subscription, unblock: make(chan struct{})}
+	subscriptions.subscription = blocking
+
+	client := newTestClient("b1", "/", nil, time.Now())
+	client.bufferSize = 100
+	cluster[1].clients["b1"] = client
+	joined := make(chan struct{})
+	go func() {
+		cluster[1].pool.AddClient(client)
+		cluster[1].pool.AddClientToRoom(client, "r")
+		close(joined)
+	}()
+	select {
+	case <-joined:
+	case <-time.After(time.Second):
+		t.Fatal("joining a room blocked on the broker")
+	}
+	close(blocking.unblock)
+	if got := cluster[1].subscribed(); got != "grows:room:r" {
+		t.Fatalf("node 1 subscribed to %q", got)
+	}
+	if err := Broadcast("r", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(received(cluster), ","); got != "b1" {
+		t.Errorf("delivered to %q", got)
+	}
+}
+
+func TestRoomShards(t *testing.T) {
+	pubsub, err := newPubSubClient(context.Background(), newClientPool(), Config{Broker: NewMemoryBroker(), RoomShards: 4, NodeID: "node"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pubsub.stop()
+	shards := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		channel := pubsub.channels.Of(Payload{Kind: PayloadRoom, Id: strconv.Itoa(i)})
+		if !strings.HasPrefix(channel, "grows:room:shard:") {
+			t.Fatalf("unexpected room channel %q", channel)
+		}
+		if channel != pubsub.channels.Room("", strconv.Itoa(i)) {
+			t.Fatalf("publish and subscribe channels of room %d differ", i)
+		}
+		shards[channel] = true
+	}
+	if len(shards) != 4 {
+		t.Errorf("expected 4 shards, got %d", len(shards))
+	}
+}
+
+func TestNodeDelivery(t *testing.T) {
+	cluster := newTestCluster(t, 2)
+	cluster[0].addClient("a1", "", "r")
+	cluster[1].addClient("b1", "", "r")
+
+	// the publishing node delivers its own messages once
+	if err := Broadcast("r", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cluster[0].clients["a1"].buffer); n != 1 {
+		t.Fatalf("expected 1 message for the local client, got %d", n)
+	}
+	if got := strings.Join(received(cluster), ","); got != "a1,b1" {
+		t.Fatalf("delivered to %q", got)
+	}
+
+	// messages sent to a node are only delivered by that node
+	if err := Node(cluster[1].pubsub.nodeID).Broadcast("r", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(received(cluster), ","); got != "b1" {
+		t.Fatalf("Node(1).Broadcast delivered to %q", got)
+	}
+	if err := Node(cluster[0].pubsub.nodeID).BroadcastToAll([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(received(cluster), ","); got != "a1" {
+		t.Fatalf("Node(0).BroadcastToAll delivered to %q", got)
+	}
+
+	// messages to local clients are not published
+	channels := make([]string, 0)
+	_, _ = cluster[1].pubsub.broker.Subscribe(context.Background(), func(channel string, payload []byte) {
+		channels = append(channels, channel)
+	}, "grows:*")
+	if err := BroadcastToClient("a1", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := BroadcastToClient("b1", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(received(cluster), ","); got != "a1,b1" {
+		t.Fatalf("BroadcastToClient delivered to %q", got)
+	}
+	if strings.Join(channels, ",") != "grows:client" {
+		t.Errorf("unexpected channels: %v", channels)
+	}
+}
+
+func TestRemoteCommands(t *testing.T) {
+	cluster := newTestCluster(t, 2)
+	cluster[0].addClient("a1", "")
+	cluster[1].addClient("b1", "")
+	cluster[1].addClient("b2", "")
+	cluster[1].setTenant("b2", "x")
+	b1 := cluster[1].clients["b1"]
+
+	if err := JoinRoom("b1", "r"); err != nil {
+		t.Fatal(err)
+	}
+	if room := cluster[1].pool.GetRoom("r"); room == nil || room.clients["b1"] != b1 || b1.GetRooms()[0] != "r" {
+		t.Fatal("expected b1 to join r on node 1")
+	}
+	// the room channel is subscribed asynchronously
+	cluster[1].pubsub.subscriptions.flush()
+	if err := Broadcast("r", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(received(cluster), ","); got != "b1" {
+		t.Fatalf("delivered to %q after join", got)
+	}
+	if err := LeaveRoom("b1", "r"); err != nil {
+		t.Fatal(err)
+	}
+	if cluster[1].pool.GetRoom("r") != nil || len(b1.GetRooms()) != 0 {
+		t.Fatal("expected b1 to leave r on node 1")
+	}
+
+	if err := SetMeta("b1", "Role", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if role, _ := b1.GetMeta("Role"); role != "admin" {
+		t.Fatalf("unexpected meta %v", role)
+	}
+
+	// commands only reach clients of the namespace
+	if err := Disconnect("b2"); err != nil {
+		t.Fatal(err)
+	}
+	if cluster[1].clients["b2"].isClosed() {
+		t.Fatal("expected b2 of tenant x not to be disconnected")
+	}
+	if err := Tenant("x").Disconnect("b2"); err != nil {
+		t.Fatal(err)
+	}
+	if !cluster[1].clients["b2"].isClosed() || b1.isClosed() {
+		t.Fatal("expected only b2 to be disconnected")
+	}
+}
+
+func TestDeliveryAcrossApps(t *testing.T) {
+	broker := NewMemoryBroker()
+	handler := NewClientHandler()
+	handler.OnConnect(func(client *Client) error {
+		return AddClientToRoom(client, "room")
+	})
+	handler.OnEvent("chat", func(client *Client, data any) error {
+		return BroadcastEvent("room", Event{Identifier: "chat", Data: client.GetID() + ":" + data.(string)})
+	})
+	apps := make([]*App, 0, 3)
+	conns := make(map[string]net.Conn)
+	for i := 0; i < 3; i++ {
+		app, err := NewApp(Config{Broker: broker, IDGenerator: func(r *http.Request) string {
+			return r.URL.Query().Get("id")
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		apps = append(apps, app)
+		server := httptest.NewServer(http.HandlerFunc(app.buildHandlerFunc("/", handler)))
+		for _, id := range []string{"c" + strconv.Itoa(i) + "a", "c" + strconv.Itoa(i) + "b"} {
+			conns[id] = dialTestServer(t, "ws"+strings.TrimPrefix(server.URL, "http")+"/?id="+id)
+			waitFor(t, func() bool { return app.pool.GetClient(id) != nil })
+		}
+		app.pubsub.subscriptions.flush()
+		t.Cleanup(func() {
+			server.Close()
+			app.pubsub.stop()
+		})
+	}
+	t.Cleanup(func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+		clientPool = newClientPool()
+	})
+
+	// every client receives the message exactly once, the next message is the marker
+	expect := func(want string) {
+		t.Helper()
+		for id, conn := range conns {
+			for _, message := range []string{want, "marker"} {
+				if event := readTestEvent(t, conn); event.Data != message {
+					t.Fatalf("%s received %v, want %q", id, event.Data, message)
+				}
+			}
+		}
+	}
+	marker := func() {
+		t.Helper()
+		if err := BroadcastEvent("room", Event{Identifier: "marker", Data: "marker"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := BroadcastEvent("room", Event{Identifier: "news", Data: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	marker()
+	expect("hi")
+
+	// an event received by the first app reaches the clients of all apps
+	if err := wsutil.WriteClientText(conns["c0a"], []byte(`{"event":"chat","data":"hello"}`)); err != nil {
+		t.Fatal(err)
+	}
+	for id, conn := range conns {
+		if event := readTestEvent(t, conn); event.Data != "c0a:hello" {
+			t.Fatalf("%s received %v", id, event.Data)
+		}
+	}
+	marker()
+	for id, conn := range conns {
+		if event := readTestEvent(t, conn); event.Data != "marker" {
+			t.Fatalf("%s received %v, want the marker", id, event.Data)
+		}
+	}
+
+	// the apps created before the default app deliver to their own clients
+	if err := BroadcastEventToClient("c0b", Event{Identifier: "direct", Data: "direct"}); err != nil {
+		t.Fatal(err)
+	}
+	if event := readTestEvent(t, conns["c0b"]); event.Data != "direct" {
+		t.Fatalf("c0b received %v", event.Data)
+	}
+}
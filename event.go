@@ -1,10 +1,32 @@
 package groWs
 
 import (
+	"bytes"
 	"encoding/json"
-	"log"
+	"errors"
 )
 
+var (
+	// ErrNotAnEvent is returned if the data is not a JSON object containing the identifier field
+	ErrNotAnEvent = errors.New("data is not an event")
+	// ErrInvalidIdentifier is returned if the identifier of an event is empty or not a string
+	ErrInvalidIdentifier = errors.New("event identifier must be a non-empty string")
+)
+
+// ErrorEventIdentifier is the identifier of the event sent to a client if one of its events is rejected
+const ErrorEventIdentifier = "error"
+
+// Error codes used in the ErrorData of error events
+const (
+	// ErrorCodeValidation is used if the data of an event did not pass the validation
+	ErrorCodeValidation = "validation_failed"
+	// ErrorCodeForbidden is used if the ACL denied the action
+	ErrorCodeForbidden = "forbidden"
+)
+
+// DefaultEventEnvelope is the envelope used if no other is configured: {"event": "...", "data": ...}
+var DefaultEventEnvelope = EventEnvelope{IdentifierField: "event", DataField: "data"}
+
 type Event struct {
 	// Event identifier used to identify the event on the client and server side
 	// The ClientHandler.OnEvent() method uses this identifier to match the event
@@ -14,38 +36,141 @@ type Event struct {
 	Data any `json:"data"`
 }
 
-// IsJSONObject checks if the data is JSON
-// This uses the first and last character of the data to check if it is JSON
-// and is not a 100% accurate way to check if the data is JSON (e.g. for an array) but is faster
-func IsJSONObject(data []byte) bool {
-	if data[0] == '{' && data[len(data)-1] == '}' {
-		return true
+// ErrorData is the data of an error event sent to a client
+type ErrorData struct {
+	// Code is a machine-readable error code (e.g. ErrorCodeValidation)
+	Code string `json:"code"`
+	// Event is the identifier of the rejected event
+	Event string `json:"event,omitempty"`
+	// Message is a human-readable description of the error
+	Message string `json:"message"`
+	// Details holds additional information (e.g. a list of violations)
+	Details any `json:"details,omitempty"`
+}
+
+// NewErrorEvent creates an error event for the rejected event with the given identifier
+func NewErrorEvent(code string, event string, message string, details any) Event {
+	return Event{
+		Identifier: ErrorEventIdentifier,
+		Data: ErrorData{
+			Code:    code,
+			Event:   event,
+			Message: message,
+			Details: details,
+		},
 	}
-	return false
 }
 
-// IsEvent checks if the data is an Event by trying to unmarshal a JSON to an Event
-func IsEvent(data []byte) bool {
-	var e Event
-	err := json.Unmarshal(data, &e)
+// EventEnvelope describes the JSON field names an Event is wrapped in on the wire
+// e.g. {"event": "...", "data": ...} (default) or {"type": "...", "payload": ...}
+type EventEnvelope struct {
+	// IdentifierField is the name of the field holding the event identifier
+	IdentifierField string `json:"identifier_field"`
+	// DataField is the name of the field holding the event data
+	DataField string `json:"data_field"`
+}
+
+// WithDefaults returns the envelope with empty field names replaced by the ones of DefaultEventEnvelope
+func (env EventEnvelope) WithDefaults() EventEnvelope {
+	if env.IdentifierField == "" {
+		env.IdentifierField = DefaultEventEnvelope.IdentifierField
+	}
+	if env.DataField == "" {
+		env.DataField = DefaultEventEnvelope.DataField
+	}
+	return env
+}
+
+// Parse decodes data into an Event in a single pass
+// It returns ErrNotAnEvent if the data is no JSON object or has no identifier field
+// (so it should be handled as raw message) and ErrInvalidIdentifier if the identifier is empty
+func (env EventEnvelope) Parse(data []byte) (Event, error) {
+	event, err := env.decode(data)
 	if err != nil {
-		log.Println(err)
-		return false
+		return event, err
 	}
-	return true
+	if event.Identifier == "" {
+		return event, ErrInvalidIdentifier
+	}
+	return event, nil
 }
 
-// FromJSON converts JSON data to an Event
-func FromJSON(data []byte) (Event, error) {
+// decode decodes data into an Event without validating the identifier value
+func (env EventEnvelope) decode(data []byte) (Event, error) {
 	var e Event
-	err := json.Unmarshal(data, &e)
-	if err != nil {
-		return e, err
+	if !IsJSONObject(data) {
+		return e, ErrNotAnEvent
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return e, ErrNotAnEvent
+	}
+	rawIdentifier, ok := fields[env.IdentifierField]
+	if !ok {
+		return e, ErrNotAnEvent
+	}
+	if err := json.Unmarshal(rawIdentifier, &e.Identifier); err != nil {
+		return e, ErrInvalidIdentifier
+	}
+	if rawData, ok := fields[env.DataField]; ok {
+		if err := json.Unmarshal(rawData, &e.Data); err != nil {
+			return e, err
+		}
 	}
 	return e, nil
 }
 
-// ToJSON converts an Event to JSON data
+// Marshal encodes an Event to JSON using the envelope field names
+func (env EventEnvelope) Marshal(e Event) ([]byte, error) {
+	identifierField, err := json.Marshal(env.IdentifierField)
+	if err != nil {
+		return nil, err
+	}
+	identifier, err := json.Marshal(e.Identifier)
+	if err != nil {
+		return nil, err
+	}
+	dataField, err := json.Marshal(env.DataField)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	buf.Write(identifierField)
+	buf.WriteByte(':')
+	buf.Write(identifier)
+	buf.WriteByte(',')
+	buf.Write(dataField)
+	buf.WriteByte(':')
+	buf.Write(data)
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// IsJSONObject checks if the data looks like a JSON object
+// This uses the first and last non-whitespace character of the data to check if it is JSON
+// and is not a 100% accurate way to check if the data is JSON but is faster
+func IsJSONObject(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) >= 2 && data[0] == '{' && data[len(data)-1] == '}'
+}
+
+// IsEvent checks if the data is an Event with a non-empty identifier (using the DefaultEventEnvelope)
+func IsEvent(data []byte) bool {
+	_, err := DefaultEventEnvelope.Parse(data)
+	return err == nil
+}
+
+// FromJSON converts JSON data to an Event (using the DefaultEventEnvelope, see EventEnvelope.Parse)
+func FromJSON(data []byte) (Event, error) {
+	return DefaultEventEnvelope.Parse(data)
+}
+
+// ToJSON converts an Event to JSON data (using the DefaultEventEnvelope, see EventEnvelope.Marshal)
 func (e Event) ToJSON() ([]byte, error) {
-	return json.Marshal(e)
+	return DefaultEventEnvelope.Marshal(e)
 }
@@ -0,0 +1,131 @@
+package groWs
+
+import (
+	"sort"
+	"strings"
+)
+
+// Event identifiers can be namespaced by separating segments with a dot (e.g. "chat.message.create").
+// Patterns used in ClientHandler.OnEvent, ClientHandler.Use and ClientHandler.ValidateEvent
+// can contain wildcard segments:
+// - "*" matches exactly one segment ("chat.*" matches "chat.join" but not "chat.message.create")
+// - "**" matches one or more segments ("chat.**" matches "chat.join" and "chat.message.create")
+// - the pattern "*" on its own matches every identifier and is only used if nothing else matches
+
+const (
+	eventSeparator      = "."
+	wildcardSegment     = "*"
+	deepWildcardSegment = "**"
+	catchAllPattern     = "*"
+)
+
+// matchEventPattern checks if the event identifier matches the pattern
+func matchEventPattern(pattern string, identifier string) bool {
+	if pattern == catchAllPattern || pattern == identifier {
+		return true
+	}
+	return matchSegments(strings.Split(pattern, eventSeparator), strings.Split(identifier, eventSeparator))
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case deepWildcardSegment:
+			if len(segments) == 0 {
+				return false
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 1; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		case wildcardSegment:
+			if len(segments) == 0 {
+				return false
+			}
+		default:
+			if len(segments) == 0 || pattern[0] != segments[0] {
+				return false
+			}
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// segmentRank ranks a pattern segment by specificity (higher is more specific)
+func segmentRank(segment string) int {
+	switch segment {
+	case deepWildcardSegment:
+		return 0
+	case wildcardSegment:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// morePreciseEventPattern reports whether pattern a is more specific than pattern b
+// segments are compared from left to right: a literal segment beats "*" which beats "**"
+func morePreciseEventPattern(a string, b string) bool {
+	if a == catchAllPattern || b == catchAllPattern {
+		return b == catchAllPattern && a != catchAllPattern
+	}
+	aSegments := strings.Split(a, eventSeparator)
+	bSegments := strings.Split(b, eventSeparator)
+	for i := 0; i < len(aSegments) && i < len(bSegments); i++ {
+		aRank, bRank := segmentRank(aSegments[i]), segmentRank(bSegments[i])
+		if aRank != bRank {
+			return aRank > bRank
+		}
+	}
+	if len(aSegments) != len(bSegments) {
+		return len(aSegments) > len(bSegments)
+	}
+	return a < b
+}
+
+// bestEventPattern returns the most specific key of patterns matching the identifier
+func bestEventPattern[T any](patterns map[string]T, identifier string) (string, bool) {
+	if _, ok := patterns[identifier]; ok {
+		return identifier, true
+	}
+	best, found := "", false
+	for pattern := range patterns {
+		if !matchEventPattern(pattern, identifier) {
+			continue
+		}
+		if !found || morePreciseEventPattern(pattern, best) {
+			best, found = pattern, true
+		}
+	}
+	return best, found
+}
+
+// matchingEventPatterns returns all keys of patterns matching the identifier
+// ordered from the least to the most specific one
+func matchingEventPatterns[T any](patterns map[string]T, identifier string) []string {
+	matches := make([]string, 0)
+	for pattern := range patterns {
+		if matchEventPattern(pattern, identifier) {
+			matches = append(matches, pattern)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return morePreciseEventPattern(matches[j], matches[i])
+	})
+	return matches
+}
+
+// namespaceEventPattern prefixes a pattern with a namespace
+// the catch-all pattern "*" becomes "<namespace>.**"
+func namespaceEventPattern(namespace string, pattern string) string {
+	if pattern == catchAllPattern {
+		return namespace + eventSeparator + deepWildcardSegment
+	}
+	return namespace + eventSeparator + pattern
+}
@@ -0,0 +1,94 @@
+package groWs
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEventEnvelopeParse(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want Event
+		err  error
+	}{
+		{name: "empty", data: "", err: ErrNotAnEvent},
+		{name: "whitespace", data: "  \n", err: ErrNotAnEvent},
+		{name: "raw", data: "test", err: ErrNotAnEvent},
+		{name: "array", data: `[1,2]`, err: ErrNotAnEvent},
+		{name: "object without identifier", data: `{"foo":1}`, err: ErrNotAnEvent},
+		{name: "malformed", data: `{"event":"test"`, err: ErrNotAnEvent},
+		{name: "empty identifier", data: `{"event":"","data":1}`, err: ErrInvalidIdentifier},
+		{name: "identifier not a string", data: `{"event":1}`, err: ErrInvalidIdentifier},
+		{name: "event", data: `{"event":"test","data":"value"}`, want: Event{Identifier: "test", Data: "value"}},
+		{name: "event without data", data: `{"event":"test"}`, want: Event{Identifier: "test"}},
+		{name: "surrounding whitespace", data: " \t{\"event\":\"test\",\"data\":true}\n", want: Event{Identifier: "test", Data: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := DefaultEventEnvelope.Parse([]byte(tt.data))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if err == nil && event != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, event)
+			}
+		})
+	}
+}
+
+func TestEventEnvelopeCustomFields(t *testing.T) {
+	env := EventEnvelope{IdentifierField: "type", DataField: "payload"}
+	event, err := env.Parse([]byte(`{"type":"chat","payload":"hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Identifier != "chat" || event.Data != "hello" {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if _, err := env.Parse([]byte(`{"event":"chat","data":"hello"}`)); !errors.Is(err, ErrNotAnEvent) {
+		t.Errorf("expected ErrNotAnEvent, got %v", err)
+	}
+	data, err := env.Marshal(Event{Identifier: "chat", Data: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"type":"chat","payload":"hello"}` {
+		t.Errorf("unexpected JSON %s", data)
+	}
+}
+
+func TestEventEnvelopePerApp(t *testing.T) {
+	broker := NewMemoryBroker()
+	custom, err := NewApp(Config{Broker: broker, EventEnvelope: EventEnvelope{IdentifierField: "type"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer custom.pubsub.stop()
+	standard, err := NewApp(Config{Broker: broker})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer standard.pubsub.stop()
+	event := Event{Identifier: "chat", Data: "hello"}
+	for app, want := range map[*App]string{
+		custom:   `{"type":"chat","data":"hello"}`,
+		standard: `{"event":"chat","data":"hello"}`,
+	} {
+		client := newTestClient("a", "/", nil, time.Now())
+		client.bufferSize = 1
+		client.app = app
+		if err := client.WriteEvent(event); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(client.buffer[0]); got != want {
+			t.Errorf("wrote %s, want %s", got, want)
+		}
+	}
+	// the JSON encoding of the type does not depend on the apps
+	if data, _ := json.Marshal(event); string(data) != `{"event":"chat","data":"hello"}` {
+		t.Errorf("unexpected JSON %s", data)
+	}
+}
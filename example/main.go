@@ -16,7 +16,10 @@ func main() {
 		RedisPort:    6379,
 	}
 
-	app := groWs.NewApp(config)
+	app, err := groWs.NewApp(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
 	app.AddRouter(handlers.ExampleRouter())
 	app.AddHandshakeMiddleware("/example", middlewares.NewBasicAuthMiddleware().HandleHandshake())
 	app.AddReceiveMiddleware("/example", middlewares.LoggerMiddlewareInstance.HandleReceive())
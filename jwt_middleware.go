@@ -0,0 +1,353 @@
+package groWs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrTokenMissing is returned if no token was found in the request
+	ErrTokenMissing = errors.New("token missing")
+	// ErrUnknownKey is returned if no key matches the key id of a token
+	ErrUnknownKey = errors.New("unknown key")
+	// ErrSubjectChanged is returned if a refresh token belongs to another subject
+	ErrSubjectChanged = errors.New("token subject changed")
+)
+
+const (
+	// JWTClaimsMetaKey is the client metadata key the verified claims (jwt.MapClaims) are stored at
+	JWTClaimsMetaKey = "jwt.claims"
+	// DefaultJWTRefreshEvent is the event identifier used by clients to send a new token
+	DefaultJWTRefreshEvent = "auth.refresh"
+	// ErrorCodeUnauthorized is used in error events if a token is invalid or expired
+	ErrorCodeUnauthorized = "unauthorized"
+)
+
+// JWTConfig configures the JWTMiddleware
+// At least one of Keys and JWKSFile must be set.
+type JWTConfig struct {
+	// Keys used to verify tokens by key id ("kid" header), a key with an empty id is used for tokens without kid.
+	// Supported are []byte (HS256), *rsa.PublicKey (RS256) and *ecdsa.PublicKey (ES256)
+	Keys map[string]interface{}
+	// JWKSFile is the path to a JSON Web Key Set file, its keys are added to Keys
+	JWKSFile string
+	// Algorithms allowed to sign tokens (default: HS256, RS256, ES256)
+	Algorithms []string
+	// Issuer and Audience are verified if set
+	Issuer   string
+	Audience string
+	// Header the token is read from, a "Bearer " prefix is removed (default: Authorization)
+	Header string
+	// QueryParam the token is read from if set (e.g. "token" for ws://host/path?token=...)
+	QueryParam string
+	// Subprotocol the token is read from if set (e.g. "access_token" for Sec-WebSocket-Protocol: access_token, <token>)
+	// The subprotocol has to be added to Config.Subprotocols so it is negotiated with the client
+	Subprotocol string
+	// ClaimsMeta maps claim names to client metadata keys (e.g. {"sub": "UserID", "role": "Role"})
+	ClaimsMeta map[string]string
+	// RefreshEvent is the event identifier used to send a new token (default: auth.refresh)
+	RefreshEvent string
+}
+
+// JWTMiddleware authenticates clients during the handshake using JSON Web Tokens
+// The verified claims are stored in the client metadata and the connection is closed when the token expires,
+// unless the client sends a new token using the refresh event before.
+type JWTMiddleware struct {
+	config JWTConfig
+	parser *jwt.Parser
+	mu     sync.Mutex
+	timers map[*Client]*time.Timer
+}
+
+// NewJWTMiddleware creates a JWTMiddleware, it returns an error if the JWKSFile can not be loaded
+func NewJWTMiddleware(config JWTConfig) (*JWTMiddleware, error) {
+	keys := make(map[string]interface{}, len(config.Keys))
+	for kid, key := range config.Keys {
+		keys[kid] = key
+	}
+	if config.JWKSFile != "" {
+		data, err := os.ReadFile(config.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		jwks, err := ParseJWKS(data)
+		if err != nil {
+			return nil, err
+		}
+		for kid, key := range jwks {
+			keys[kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwt: no keys configured")
+	}
+	config.Keys = keys
+	if len(config.Algorithms) == 0 {
+		config.Algorithms = []string{"HS256", "RS256", "ES256"}
+	}
+	if config.Header == "" {
+		config.Header = "Authorization"
+	}
+	if config.RefreshEvent == "" {
+		config.RefreshEvent = DefaultJWTRefreshEvent
+	}
+	options := []jwt.ParserOption{jwt.WithValidMethods(config.Algorithms), jwt.WithExpirationRequired()}
+	if config.Issuer != "" {
+		options = append(options, jwt.WithIssuer(config.Issuer))
+	}
+	if config.Audience != "" {
+		options = append(options, jwt.WithAudience(config.Audience))
+	}
+	return &JWTMiddleware{
+		config: config,
+		parser: jwt.NewParser(options...),
+		timers: make(map[*Client]*time.Timer),
+	}, nil
+}
+
+// HandleHandshake returns a HandshakeMiddleware that rejects clients without a valid token
+func (m *JWTMiddleware) HandleHandshake() HandshakeMiddleware {
+	return func(r *http.Request, client *Client) bool {
+		token, err := m.tokenFromRequest(r)
+		if err != nil {
+			return false
+		}
+		claims, err := m.Verify(token)
+		if err != nil {
+			return false
+		}
+		m.authenticate(client, claims)
+		client.onClose(m, func() {
+			m.stopTimer(client)
+		})
+		return true
+	}
+}
+
+// HandleRefresh returns an event handler for the refresh event that replaces the token of the client
+// The data of the event is the new token (or an object with a "token" field),
+// it has to belong to the same subject. The client receives the refresh event with the new expiry on success.
+func (m *JWTMiddleware) HandleRefresh() func(client *Client, data interface{}) error {
+	return func(client *Client, data interface{}) error {
+		token := ""
+		switch value := data.(type) {
+		case string:
+			token = value
+		case map[string]interface{}:
+			token, _ = value["token"].(string)
+		}
+		claims, err := m.Verify(token)
+		if err == nil {
+			err = m.checkSubject(client, claims)
+		}
+		if err != nil {
+			return client.WriteEvent(NewErrorEvent(ErrorCodeUnauthorized, m.config.RefreshEvent, err.Error(), nil))
+		}
+		expiresAt := m.authenticate(client, claims)
+		return client.WriteEvent(Event{
+			Identifier: m.config.RefreshEvent,
+			Data:       map[string]interface{}{"expires_at": expiresAt.Unix()},
+		})
+	}
+}
+
+// Register registers the refresh event handler on the ClientHandler
+func (m *JWTMiddleware) Register(handler *ClientHandler) {
+	handler.OnEvent(m.config.RefreshEvent, m.HandleRefresh())
+}
+
+// Verify parses and verifies a token and returns its claims
+func (m *JWTMiddleware) Verify(token string) (jwt.MapClaims, error) {
+	if token == "" {
+		return nil, ErrTokenMissing
+	}
+	claims := jwt.MapClaims{}
+	_, err := m.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := m.config.Keys[kid]
+		if !ok {
+			return nil, ErrUnknownKey
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// authenticate stores the claims in the client metadata and (re)starts the expiry timer
+func (m *JWTMiddleware) authenticate(client *Client, claims jwt.MapClaims) time.Time {
+	client.SetMeta(JWTClaimsMetaKey, claims)
+	for claim, key := range m.config.ClaimsMeta {
+		if value, ok := claims[claim]; ok {
+			client.SetMeta(key, value)
+		}
+	}
+	expiresAt := time.Now()
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		expiresAt = exp.Time
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if timer := m.timers[client]; timer != nil {
+		timer.Stop()
+	}
+	m.timers[client] = time.AfterFunc(time.Until(expiresAt), func() {
+		m.stopTimer(client)
+		_ = client.WriteEvent(NewErrorEvent(ErrorCodeUnauthorized, m.config.RefreshEvent, "token expired", nil))
+		_ = client.Close()
+	})
+	return expiresAt
+}
+
+// stopTimer stops and removes the expiry timer of the client
+func (m *JWTMiddleware) stopTimer(client *Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if timer := m.timers[client]; timer != nil {
+		timer.Stop()
+		delete(m.timers, client)
+	}
+}
+
+// checkSubject checks if the claims belong to the same subject as the current claims of the client
+func (m *JWTMiddleware) checkSubject(client *Client, claims jwt.MapClaims) error {
+	current, err := client.GetMeta(JWTClaimsMetaKey)
+	if err != nil {
+		return err
+	}
+	currentClaims, ok := current.(jwt.MapClaims)
+	if !ok {
+		return ErrSubjectChanged
+	}
+	currentSubject, _ := currentClaims.GetSubject()
+	subject, _ := claims.GetSubject()
+	if currentSubject != subject {
+		return ErrSubjectChanged
+	}
+	return nil
+}
+
+// tokenFromRequest reads the token from the configured header, query param or subprotocol
+func (m *JWTMiddleware) tokenFromRequest(r *http.Request) (string, error) {
+	if value := r.Header.Get(m.config.Header); value != "" {
+		if len(value) > 7 && strings.EqualFold(value[:7], "bearer ") {
+			value = value[7:]
+		}
+		return strings.TrimSpace(value), nil
+	}
+	if m.config.QueryParam != "" {
+		if value := r.URL.Query().Get(m.config.QueryParam); value != "" {
+			return value, nil
+		}
+	}
+	if m.config.Subprotocol != "" {
+		protocols := make([]string, 0)
+		for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+			for _, protocol := range strings.Split(header, ",") {
+				protocols = append(protocols, strings.TrimSpace(protocol))
+			}
+		}
+		for i := 0; i < len(protocols)-1; i++ {
+			if protocols[i] == m.config.Subprotocol {
+				return protocols[i+1], nil
+			}
+		}
+	}
+	return "", ErrTokenMissing
+}
+
+// jsonWebKey is a single key of a JSON Web Key Set
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// ParseJWKS parses a JSON Web Key Set into keys by key id usable in JWTConfig.Keys
+// Supported key types are RSA, EC (P-256, P-384, P-521) and oct
+func ParseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, jwk := range set.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwks: key %q: %w", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// publicKey converts the JSON Web Key into a key usable to verify tokens
+func (jwk jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBase64URL(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64URL(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBase64URL(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64URL(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return key, nil
+	case "oct":
+		return decodeBase64URL(jwk.K)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+// decodeBase64URL decodes base64url data with or without padding
+func decodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
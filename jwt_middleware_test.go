@@ -0,0 +1,106 @@
+package groWs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestJWTMiddlewareVerify(t *testing.T) {
+	secret := []byte("secret")
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := fmt.Sprintf(`{"keys":[{"kty":"EC","kid":"ec","crv":"P-256","x":"%s","y":"%s"}]}`,
+		base64.RawURLEncoding.EncodeToString(ecKey.X.Bytes()), base64.RawURLEncoding.EncodeToString(ecKey.Y.Bytes()))
+	keys, err := ParseJWKS([]byte(jwks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys["hs"] = secret
+	m, err := NewJWTMiddleware(JWTConfig{Keys: keys, QueryParam: "token", Subprotocol: "access_token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(method jwt.SigningMethod, kid string, key interface{}, exp time.Time) string {
+		token := jwt.NewWithClaims(method, jwt.MapClaims{"sub": "user-1", "exp": exp.Unix()})
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	valid := sign(jwt.SigningMethodHS256, "hs", secret, time.Now().Add(time.Hour))
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"hs256", valid, true},
+		{"es256", sign(jwt.SigningMethodES256, "ec", ecKey, time.Now().Add(time.Hour)), true},
+		{"expired", sign(jwt.SigningMethodHS256, "hs", secret, time.Now().Add(-time.Hour)), false},
+		{"unknown kid", sign(jwt.SigningMethodHS256, "other", secret, time.Now().Add(time.Hour)), false},
+		{"wrong key type", sign(jwt.SigningMethodHS256, "ec", secret, time.Now().Add(time.Hour)), false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		if _, err := m.Verify(tt.token); (err == nil) != tt.ok {
+			t.Errorf("%s: unexpected result %v", tt.name, err)
+		}
+	}
+
+	query := httptest.NewRequest("GET", "/ws?token="+valid, nil)
+	if token, err := m.tokenFromRequest(query); err != nil || token != valid {
+		t.Errorf("expected token from query param, got %q (%v)", token, err)
+	}
+	protocol := httptest.NewRequest("GET", "/ws", nil)
+	protocol.Header.Set("Sec-WebSocket-Protocol", "access_token, "+valid)
+	if token, err := m.tokenFromRequest(protocol); err != nil || token != valid {
+		t.Errorf("expected token from subprotocol, got %q (%v)", token, err)
+	}
+}
+
+func TestJWTMiddlewareHandshake(t *testing.T) {
+	secret := []byte("secret")
+	m, err := NewJWTMiddleware(JWTConfig{Keys: map[string]interface{}{"hs": secret}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user-1", "exp": time.Now().Add(time.Hour).Unix()})
+	token.Header["kid"] = "hs"
+	signed, err := token.SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("Authorization", "Bearer "+signed)
+	client := NewClient(nil, nil)
+	handshake := m.HandleHandshake()
+	for i := 0; i < 3; i++ {
+		if !handshake(r, client) {
+			t.Fatal("expected handshake to succeed")
+		}
+	}
+	if len(client.closeHandlers) != 1 {
+		t.Errorf("expected 1 close handler after repeated handshakes, got %d", len(client.closeHandlers))
+	}
+	client.runCloseHandlers()
+	if len(m.timers) != 0 {
+		t.Errorf("expected expiry timer to be stopped, got %d", len(m.timers))
+	}
+
+	client.SetMeta(JWTClaimsMetaKey, "not claims")
+	claims, _ := m.Verify(signed)
+	if err := m.checkSubject(client, claims); err != ErrSubjectChanged {
+		t.Errorf("expected ErrSubjectChanged for invalid claims metadata, got %v", err)
+	}
+}
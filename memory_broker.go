@@ -0,0 +1,129 @@
+package groWs
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// memorySubscription is a handler subscribed to a set of channels of a MemoryBroker
+type memorySubscription struct {
+	broker   *MemoryBroker
+	ctx      context.Context
+	handler  MessageHandler
+	channels map[string]bool
+}
+
+// matches checks if the channel or a pattern matching it is subscribed (broker.mu must be held)
+func (s *memorySubscription) matches(channel string) bool {
+	if s.channels[channel] {
+		return true
+	}
+	for pattern := range s.channels {
+		if strings.HasSuffix(pattern, "*") && strings.HasPrefix(channel, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribe adds channels to the subscription
+func (s *memorySubscription) Subscribe(_ context.Context, channels ...string) error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	for _, channel := range channels {
+		s.channels[channel] = true
+	}
+	return nil
+}
+
+// Unsubscribe removes channels from the subscription
+func (s *memorySubscription) Unsubscribe(_ context.Context, channels ...string) error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	for _, channel := range channels {
+		delete(s.channels, channel)
+	}
+	return nil
+}
+
+// Close removes the subscription from the broker
+func (s *memorySubscription) Close() error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	for i, subscription := range s.broker.subscriptions {
+		if subscription == s {
+			s.broker.subscriptions = append(s.broker.subscriptions[:i], s.broker.subscriptions[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// MemoryBroker is an in-process Broker for single node deployments and tests
+// Messages are delivered synchronously to all subscriptions, so multiple nodes
+// (e.g. in tests) can share one MemoryBroker.
+type MemoryBroker struct {
+	mu            sync.RWMutex
+	subscriptions []*memorySubscription
+	closed        bool
+}
+
+// NewMemoryBroker creates an in-process Broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subscriptions: make([]*memorySubscription, 0)}
+}
+
+// Publish calls the handlers of all subscriptions of the channel
+func (b *MemoryBroker) Publish(_ context.Context, channel string, payload []byte) error {
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return ErrBrokerClosed
+	}
+	handlers := make([]MessageHandler, 0, len(b.subscriptions))
+	for _, subscription := range b.subscriptions {
+		if subscription.ctx.Err() == nil && subscription.matches(channel) {
+			handlers = append(handlers, subscription.handler)
+		}
+	}
+	b.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(channel, payload)
+	}
+	return nil
+}
+
+// Subscribe adds a subscription for the channels, that ends when the context is done
+func (b *MemoryBroker) Subscribe(ctx context.Context, handler MessageHandler, channels ...string) (Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+	subscription := &memorySubscription{broker: b, ctx: ctx, handler: handler, channels: make(map[string]bool, len(channels))}
+	for _, channel := range channels {
+		subscription.channels[channel] = true
+	}
+	b.subscriptions = append(b.subscriptions, subscription)
+	return subscription, nil
+}
+
+// Health returns ErrBrokerClosed if the broker is closed
+func (b *MemoryBroker) Health(_ context.Context) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrBrokerClosed
+	}
+	return nil
+}
+
+// Close removes all subscriptions
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.subscriptions = nil
+	return nil
+}
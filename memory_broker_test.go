@@ -0,0 +1,158 @@
+package groWs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryBroker(t *testing.T) {
+	broker := NewMemoryBroker()
+	received := make([]string, 0)
+	_, err := broker.Subscribe(context.Background(), func(channel string, payload []byte) {
+		received = append(received, channel+"="+string(payload))
+	}, "a", "b", "p:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = broker.Publish(context.Background(), "a", []byte("1"))
+	_ = broker.Publish(context.Background(), "c", []byte("2"))
+	_ = broker.Publish(context.Background(), "b", []byte("3"))
+	_ = broker.Publish(context.Background(), "p:x", []byte("4"))
+	if len(received) != 3 || received[0] != "a=1" || received[1] != "b=3" || received[2] != "p:x=4" {
+		t.Fatalf("unexpected messages: %v", received)
+	}
+	if err := broker.Health(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_ = broker.Close()
+	if err := broker.Publish(context.Background(), "a", []byte("4")); !errors.Is(err, ErrBrokerClosed) {
+		t.Fatalf("expected ErrBrokerClosed, got %v", err)
+	}
+	if err := broker.Health(context.Background()); !errors.Is(err, ErrBrokerClosed) {
+		t.Fatalf("expected ErrBrokerClosed, got %v", err)
+	}
+}
+
+func TestPubSubClientDeliversEventToRoom(t *testing.T) {
+	broker := NewMemoryBroker()
+	if err := initPubSubClient(context.Background(), Config{Broker: broker, NodeID: "node"}); err != nil {
+		t.Fatal(err)
+	}
+	received := make([]string, 0)
+	_, _ = broker.Subscribe(context.Background(), func(channel string, payload []byte) {
+		received = append(received, channel)
+	}, "grows:room:*")
+	if err := BroadcastEvent("room", Event{Identifier: "chat", Data: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 || received[0] != "grows:room:room" {
+		t.Fatalf("expected event to be published to grows:room:room, got %v", received)
+	}
+}
+
+// failingBroker is a MemoryBroker that can be made unreachable
+type failingBroker struct {
+	*MemoryBroker
+	mu   sync.Mutex
+	down bool
+}
+
+func (b *failingBroker) setDown(down bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.down = down
+}
+
+func (b *failingBroker) err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down {
+		return errors.New("broker down")
+	}
+	return nil
+}
+
+func (b *failingBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	if err := b.err(); err != nil {
+		return err
+	}
+	return b.MemoryBroker.Publish(ctx, channel, payload)
+}
+
+func (b *failingBroker) Health(context.Context) error {
+	return b.err()
+}
+
+// blockingBroker is a MemoryBroker whose Publish blocks until the context is done
+type blockingBroker struct {
+	*MemoryBroker
+}
+
+func (b *blockingBroker) Publish(ctx context.Context, _ string, _ []byte) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestPubSubClientPublishTimeout(t *testing.T) {
+	pubsub, err := newPubSubClient(context.Background(), newClientPool(), Config{Broker: &blockingBroker{NewMemoryBroker()},
+		NodeID: "node", BrokerPublishTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pubsub.stop()
+	start := time.Now()
+	if err := pubsub.publish(Payload{Kind: PayloadAll, Message: []byte("message")}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the publish to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("publish blocked for %s", elapsed)
+	}
+	if state, _ := pubsub.getState(); state != BrokerDisconnected {
+		t.Fatalf("expected disconnected state, got %s", state)
+	}
+}
+
+func TestPubSubClientDegradedMode(t *testing.T) {
+	broker := &failingBroker{MemoryBroker: NewMemoryBroker()}
+	if err := initPubSubClient(context.Background(), Config{Broker: broker, NodeID: "node", BrokerHealthInterval: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	pubsub, _ := getPubSubClient()
+	states := make(chan BrokerState, 10)
+	pubsub.onStateChange(func(state BrokerState, err error) {
+		states <- state
+	})
+	client := newTestClient("degraded", "/", nil, time.Now())
+	client.bufferSize = 10
+	GetClientPool().AddClient(client)
+	defer GetClientPool().RemoveClient(client)
+
+	broker.setDown(true)
+	if err := BroadcastEventToClient("degraded", Event{Identifier: "order", Data: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := BroadcastEventToAll(Event{Identifier: "order", Data: 2}); err == nil {
+		t.Fatal("expected the broker error")
+	}
+	if len(client.buffer) != 2 {
+		t.Fatalf("expected local delivery while the broker is down, got %d messages", len(client.buffer))
+	}
+	if state := <-states; state != BrokerDisconnected {
+		t.Fatalf("expected disconnected state, got %s", state)
+	}
+	broker.setDown(false)
+	select {
+	case state := <-states:
+		if state != BrokerConnected {
+			t.Fatalf("expected connected state, got %s", state)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("health check did not detect the recovered broker")
+	}
+	if state, err := pubsub.getState(); state != BrokerConnected || err != nil {
+		t.Fatalf("unexpected state %s (%v)", state, err)
+	}
+}
@@ -0,0 +1,79 @@
+package groWs
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// MetaOp is the operator of a MetaCondition
+type MetaOp string
+
+const (
+	// MetaOpEquals matches if the metadata equals the value
+	MetaOpEquals MetaOp = "eq"
+	// MetaOpIn matches if the metadata equals one of the values
+	MetaOpIn MetaOp = "in"
+	// MetaOpExists matches if the metadata is set
+	MetaOpExists MetaOp = "exists"
+)
+
+// MetaCondition is a condition on the metadata of a client
+// Values are compared by their JSON encoding, so filters published to other nodes match the same clients
+// (e.g. the int 1 equals the float64 1).
+type MetaCondition struct {
+	Key    string        `json:"key"`
+	Op     MetaOp        `json:"op"`
+	Values []interface{} `json:"values,omitempty"`
+}
+
+// MetaFilter matches clients satisfying all conditions
+// e.g. all admins in tenant X: MetaFilter{MetaEquals("Tenant", "X"), MetaIn("Role", "admin", "owner")}
+type MetaFilter []MetaCondition
+
+// MetaEquals returns a condition matching clients with the metadata value
+func MetaEquals(key string, value interface{}) MetaCondition {
+	return MetaCondition{Key: key, Op: MetaOpEquals, Values: []interface{}{value}}
+}
+
+// MetaIn returns a condition matching clients with one of the metadata values
+func MetaIn(key string, values ...interface{}) MetaCondition {
+	return MetaCondition{Key: key, Op: MetaOpIn, Values: values}
+}
+
+// MetaExists returns a condition matching clients with the metadata key
+func MetaExists(key string) MetaCondition {
+	return MetaCondition{Key: key, Op: MetaOpExists}
+}
+
+// Matches checks if the client satisfies all conditions of the filter
+func (f MetaFilter) Matches(client *Client) bool {
+	for _, condition := range f {
+		if !condition.Matches(client) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches checks if the client satisfies the condition
+func (c MetaCondition) Matches(client *Client) bool {
+	value, err := client.GetMeta(c.Key)
+	if err != nil {
+		return false
+	}
+	switch c.Op {
+	case MetaOpExists:
+		return true
+	case MetaOpEquals, MetaOpIn:
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return false
+		}
+		for _, v := range c.Values {
+			if other, err := json.Marshal(v); err == nil && bytes.Equal(encoded, other) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package groWs
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMetaFilterMatches(t *testing.T) {
+	client := newTestClient("a", "/", map[string]interface{}{"Tenant": "x", "Role": "admin", "Level": 3}, time.Now())
+	tests := []struct {
+		filter MetaFilter
+		want   bool
+	}{
+		{MetaFilter{}, true},
+		{MetaFilter{MetaEquals("Tenant", "x")}, true},
+		{MetaFilter{MetaEquals("Tenant", "y")}, false},
+		{MetaFilter{MetaEquals("Tenant", "x"), MetaIn("Role", "admin", "owner")}, true},
+		{MetaFilter{MetaEquals("Tenant", "x"), MetaIn("Role", "owner")}, false},
+		{MetaFilter{MetaExists("Role")}, true},
+		{MetaFilter{MetaExists("Missing")}, false},
+		{MetaFilter{MetaEquals("Level", 3.0)}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Matches(client); got != tt.want {
+			t.Errorf("%+v: got %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestMetaFilterJSONRoundTrip(t *testing.T) {
+	client := newTestClient("a", "/", map[string]interface{}{"Level": 3}, time.Now())
+	data, _ := json.Marshal(MetaFilter{MetaIn("Level", 1, 3)})
+	var filter MetaFilter
+	if err := json.Unmarshal(data, &filter); err != nil {
+		t.Fatal(err)
+	}
+	if !filter.Matches(client) {
+		t.Fatalf("decoded filter %s does not match", data)
+	}
+}
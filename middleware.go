@@ -1,9 +1,24 @@
 package groWs
 
-import "net/http"
+import (
+	"errors"
+	"net/http"
+)
 
+// ErrDropMessage can be returned (or wrapped) by a ReceiveMiddleware to drop a message
+var ErrDropMessage = errors.New("message dropped")
+
+// ReceiveMiddleware is called for every message received
+// Errors are logged and the message is still handled, unless the error is (or wraps) ErrDropMessage.
 type ReceiveMiddleware func(*Client, []byte) ([]byte, error)
 
 type SendMiddleware func(*Client, []byte) ([]byte, error)
 
+// HandshakeMiddleware is called once per connection before the websocket upgrade, returning false rejects it
+// The client is not connected yet: only the request, ID and metadata can be used,
+// writes return ErrNotConnected. Use ClientHandler.OnConnect to write to the client.
 type HandshakeMiddleware = func(r *http.Request, client *Client) bool
+
+// EventMiddleware is called with the decoded event before the event handler is called
+// The event can be modified, returning an error stops the handling of the event
+type EventMiddleware func(client *Client, event *Event) error
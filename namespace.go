@@ -0,0 +1,156 @@
+package groWs
+
+// Namespace addresses the clients of a tenant (see Client.SetTenant)
+// Messages sent to a namespace are published to the channels of the tenant and only delivered to its clients,
+// so broadcasts of one tenant can never reach the clients of another tenant.
+type Namespace struct {
+	// pubsub of the app publishing the messages (nil for the default app, see NewApp)
+	pubsub *pubSubClient
+	tenant string
+	// node is the ID of the only node delivering the messages (empty = all nodes)
+	node string
+}
+
+// defaultNamespace addresses the clients without tenant of the default app
+var defaultNamespace = Namespace{}
+
+// Tenant returns the namespace of the tenant of the default app
+func Tenant(tenant string) Namespace {
+	return Namespace{tenant: tenant}
+}
+
+// Node returns the namespace of the clients without tenant connected to the node (see App.NodeID)
+// Messages are sent to the channel of the node, so no other node receives them.
+func Node(id string) Namespace {
+	return Namespace{node: id}
+}
+
+// Namespace returns the namespace of the clients without tenant of the app
+// In contrast to the package-level functions (e.g. Broadcast), it always uses the broker and channels of this app.
+func (a *App) Namespace() Namespace {
+	return Namespace{pubsub: a.pubsub}
+}
+
+// Tenant returns the namespace of the tenant of the app
+func (a *App) Tenant(tenant string) Namespace {
+	return Namespace{pubsub: a.pubsub, tenant: tenant}
+}
+
+// Node returns the namespace of the clients without tenant of the app connected to the node
+func (a *App) Node(id string) Namespace {
+	return Namespace{pubsub: a.pubsub, node: id}
+}
+
+// Node returns the namespace limited to the clients connected to the node
+func (n Namespace) Node(id string) Namespace {
+	n.node = id
+	return n
+}
+
+// client returns the pub/sub client of the app of the namespace
+func (n Namespace) client() (*pubSubClient, error) {
+	if n.pubsub != nil {
+		return n.pubsub, nil
+	}
+	return getPubSubClient()
+}
+
+// publish sends the payload to the clients of the namespace
+func (n Namespace) publish(payload Payload) error {
+	client, err := n.client()
+	if err != nil {
+		return err
+	}
+	payload.Tenant = n.tenant
+	payload.Node = n.node
+	return client.publish(payload)
+}
+
+// publishEvent encodes the event using the envelope of the app and sends it to the clients of the namespace
+func (n Namespace) publishEvent(payload Payload, event Event) error {
+	client, err := n.client()
+	if err != nil {
+		return err
+	}
+	json, err := client.envelope.Marshal(event)
+	if err != nil {
+		return err
+	}
+	payload.Message = json
+	return n.publish(payload)
+}
+
+// Broadcast sends a Message to all clients in a room
+func (n Namespace) Broadcast(roomId string, message []byte) error {
+	return n.publish(Payload{Kind: PayloadRoom, Id: roomId, Message: message})
+}
+
+// BroadcastToAll sends a Message to all clients connected
+func (n Namespace) BroadcastToAll(message []byte) error {
+	return n.publish(Payload{Kind: PayloadAll, Message: message})
+}
+
+// BroadcastEvent sends an event to all clients in a room
+func (n Namespace) BroadcastEvent(roomId string, event Event) error {
+	return n.publishEvent(Payload{Kind: PayloadRoom, Id: roomId}, event)
+}
+
+// BroadcastEventToAll sends an event to all clients
+func (n Namespace) BroadcastEventToAll(event Event) error {
+	return n.publishEvent(Payload{Kind: PayloadAll}, event)
+}
+
+// BroadcastExcept sends a Message to all clients except the client with the given id
+func (n Namespace) BroadcastExcept(id string, message []byte) error {
+	return n.publish(Payload{Kind: PayloadAll, Except: id, Message: message})
+}
+
+// BroadcastEventExcept sends an event to all clients except the client with the given Id
+func (n Namespace) BroadcastEventExcept(id string, event Event) error {
+	return n.publishEvent(Payload{Kind: PayloadAll, Except: id}, event)
+}
+
+// BroadcastByMeta sends a Message to all clients with a specific metadata
+func (n Namespace) BroadcastByMeta(key string, value interface{}, message []byte) error {
+	return n.BroadcastByFilter(MetaFilter{MetaEquals(key, value)}, message)
+}
+
+// BroadcastEventByMeta sends an event to all clients with a specific metadata
+func (n Namespace) BroadcastEventByMeta(key string, value interface{}, event Event) error {
+	return n.BroadcastEventByFilter(MetaFilter{MetaEquals(key, value)}, event)
+}
+
+// BroadcastByFilter sends a Message to all clients matching the metadata filter
+func (n Namespace) BroadcastByFilter(filter MetaFilter, message []byte) error {
+	return n.publish(Payload{Kind: PayloadMeta, Filter: filter, Message: message})
+}
+
+// BroadcastEventByFilter sends an event to all clients matching the metadata filter
+func (n Namespace) BroadcastEventByFilter(filter MetaFilter, event Event) error {
+	return n.publishEvent(Payload{Kind: PayloadMeta, Filter: filter}, event)
+}
+
+// BroadcastToClient sends a Message to a client with the given Id
+func (n Namespace) BroadcastToClient(id string, message []byte) error {
+	return n.publish(Payload{Kind: PayloadClient, Id: id, Message: message})
+}
+
+// BroadcastEventToClient sends an event to a client with the given Id
+func (n Namespace) BroadcastEventToClient(id string, event Event) error {
+	return n.publishEvent(Payload{Kind: PayloadClient, Id: id}, event)
+}
+
+// SendToUser sends a Message to all clients of a user (see Client.SetUserID)
+func (n Namespace) SendToUser(userID string, message []byte) error {
+	return n.publish(Payload{Kind: PayloadUser, Id: userID, Message: message})
+}
+
+// SendEventToUser sends an event to all clients of a user
+func (n Namespace) SendEventToUser(userID string, event Event) error {
+	return n.publishEvent(Payload{Kind: PayloadUser, Id: userID}, event)
+}
+
+// DisconnectUser closes the connections of all clients of a user
+func (n Namespace) DisconnectUser(userID string) error {
+	return n.publish(Payload{Kind: PayloadDisconnectUser, Id: userID})
+}
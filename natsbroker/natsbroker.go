@@ -0,0 +1,217 @@
+// Package natsbroker provides a groWs Broker using NATS
+//
+// groWs channels are mapped to NATS subjects by replacing ":" with "." (e.g. "grows:room:<id>" is
+// published to "grows.room.<id>"), so nodes can subscribe to single rooms or use NATS wildcards.
+package natsbroker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	groWs "github.com/kesimo/grows"
+	"github.com/nats-io/nats.go"
+)
+
+// ErrNotConnected is returned by Health if the connection to the NATS server is not established
+var ErrNotConnected = errors.New("nats: not connected")
+
+// FlushTimeout is used to wait for the server if the context has no deadline
+var FlushTimeout = 5 * time.Second
+
+// Broker is a groWs.Broker using NATS core pub/sub
+type Broker struct {
+	conn          *nats.Conn
+	mu            sync.Mutex
+	subscriptions []*subscription
+}
+
+var _ groWs.Broker = (*Broker)(nil)
+
+// New creates a Broker using an established NATS connection (closed by Broker.Close)
+func New(conn *nats.Conn) *Broker {
+	return &Broker{conn: conn}
+}
+
+// Connect connects to the NATS server(s) and creates a Broker
+// The connection reconnects forever with backoff and resubscribes (can be changed with nats.MaxReconnects)
+func Connect(url string, options ...nats.Option) (*Broker, error) {
+	options = append([]nats.Option{nats.MaxReconnects(-1)}, options...)
+	conn, err := nats.Connect(url, options...)
+	if err != nil {
+		return nil, err
+	}
+	return New(conn), nil
+}
+
+// Conn returns the underlying NATS connection
+func (b *Broker) Conn() *nats.Conn {
+	return b.conn
+}
+
+// Publish publishes the payload to the subject of the channel
+func (b *Broker) Publish(_ context.Context, channel string, payload []byte) error {
+	return b.conn.Publish(Subject(channel), payload)
+}
+
+// Subscribe subscribes to the subjects of the channels, a channel ending with ":*" subscribes
+// to all subjects below the prefix (e.g. "grows:room:*" is mapped to "grows.room.>")
+func (b *Broker) Subscribe(ctx context.Context, handler groWs.MessageHandler, channels ...string) (groWs.Subscription, error) {
+	s := &subscription{broker: b, handler: handler, subs: make(map[string]*nats.Subscription, len(channels))}
+	if err := s.Subscribe(ctx, channels...); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	b.subscriptions = append(b.subscriptions, s)
+	b.mu.Unlock()
+	return s, nil
+}
+
+// subscription is a set of NATS subscriptions calling the same handler
+type subscription struct {
+	broker  *Broker
+	handler groWs.MessageHandler
+	// subs are the NATS subscriptions by channel, guarded by broker.mu
+	subs map[string]*nats.Subscription
+}
+
+// Subscribe subscribes to the subjects of the channels not subscribed yet
+func (s *subscription) Subscribe(ctx context.Context, channels ...string) error {
+	subs := make(map[string]*nats.Subscription, len(channels))
+	s.broker.mu.Lock()
+	for _, channel := range channels {
+		if s.subs[channel] != nil || subs[channel] != nil {
+			continue
+		}
+		sub, err := s.broker.conn.Subscribe(Subject(channel), func(msg *nats.Msg) {
+			s.handler(Channel(msg.Subject), msg.Data)
+		})
+		if err != nil {
+			s.broker.mu.Unlock()
+			for _, sub := range subs {
+				_ = sub.Unsubscribe()
+			}
+			return err
+		}
+		subs[channel] = sub
+	}
+	for channel, sub := range subs {
+		s.subs[channel] = sub
+	}
+	s.broker.mu.Unlock()
+	// make sure the server processed the subscriptions before messages are published
+	return s.broker.flush(ctx)
+}
+
+// Unsubscribe removes the subscriptions of the channels
+func (s *subscription) Unsubscribe(_ context.Context, channels ...string) error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	for _, channel := range channels {
+		if sub := s.subs[channel]; sub != nil {
+			delete(s.subs, channel)
+			if err := sub.Unsubscribe(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close removes all subscriptions
+func (s *subscription) Close() error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	s.closeLocked()
+	for i, subscription := range s.broker.subscriptions {
+		if subscription == s {
+			s.broker.subscriptions = append(s.broker.subscriptions[:i], s.broker.subscriptions[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// closeLocked unsubscribes from all channels (broker.mu must be held)
+func (s *subscription) closeLocked() {
+	for channel, sub := range s.subs {
+		_ = sub.Unsubscribe()
+		delete(s.subs, channel)
+	}
+}
+
+// Health returns an error if the NATS server is not reachable
+func (b *Broker) Health(ctx context.Context) error {
+	if !b.conn.IsConnected() {
+		return ErrNotConnected
+	}
+	return b.flush(ctx)
+}
+
+// flush waits for the server to process all buffered commands (at most FlushTimeout without a context deadline)
+func (b *Broker) flush(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, FlushTimeout)
+		defer cancel()
+	}
+	return b.conn.FlushWithContext(ctx)
+}
+
+// Close removes the subscriptions and closes the connection
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	for _, s := range b.subscriptions {
+		s.closeLocked()
+	}
+	b.subscriptions = nil
+	b.mu.Unlock()
+	b.conn.Close()
+	return nil
+}
+
+// Subject returns the NATS subject of a groWs channel
+// Characters not allowed in subject tokens (".", "*", ">", whitespace) are percent encoded.
+func Subject(channel string) string {
+	pattern := strings.HasSuffix(channel, ":*")
+	if pattern {
+		channel = strings.TrimSuffix(channel, ":*")
+	}
+	tokens := strings.Split(channel, ":")
+	for i, token := range tokens {
+		tokens[i] = escapeToken(token)
+	}
+	if pattern {
+		tokens = append(tokens, ">")
+	}
+	return strings.Join(tokens, ".")
+}
+
+// Channel returns the groWs channel of a NATS subject (inverse of Subject)
+func Channel(subject string) string {
+	tokens := strings.Split(subject, ".")
+	for i, token := range tokens {
+		if unescaped, err := url.PathUnescape(token); err == nil {
+			tokens[i] = unescaped
+		}
+	}
+	return strings.Join(tokens, ":")
+}
+
+// escapeToken percent encodes characters that are not allowed in a subject token
+func escapeToken(token string) string {
+	var sb strings.Builder
+	for _, r := range token {
+		switch r {
+		case '.', '*', '>', '%', ' ', '\t', '\r', '\n':
+			sb.WriteString(fmt.Sprintf("%%%02X", r))
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,109 @@
+package natsbroker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// runServer starts an embedded NATS server on a random port
+func runServer(t *testing.T) *server.Server {
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+func TestSubjectMapping(t *testing.T) {
+	tests := map[string]string{
+		"grows:all:clients": "grows.all.clients",
+		"grows:room:lobby":  "grows.room.lobby",
+		"grows:room:a.b *":  "grows.room.a%2Eb%20%2A",
+		"grows:room:*":      "grows.room.>",
+	}
+	for channel, subject := range tests {
+		if got := Subject(channel); got != subject {
+			t.Errorf("Subject(%q) = %q, want %q", channel, got, subject)
+		}
+	}
+	for _, channel := range []string{"grows:all:clients", "grows:room:a.b *", "grows:room:x:y"} {
+		if got := Channel(Subject(channel)); got != channel {
+			t.Errorf("Channel(Subject(%q)) = %q", channel, got)
+		}
+	}
+}
+
+func TestBroker(t *testing.T) {
+	ns := runServer(t)
+	publisher, err := Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	subscriber, err := Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+
+	received := make(chan string, 10)
+	subscription, err := subscriber.Subscribe(context.Background(), func(channel string, payload []byte) {
+		received <- channel + "=" + string(payload)
+	}, "grows:all:clients", "grows:room:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := subscriber.Health(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_ = publisher.Publish(context.Background(), "grows:all:clients", []byte("1"))
+	_ = publisher.Publish(context.Background(), "grows:room:a.b", []byte("2"))
+	_ = publisher.Publish(context.Background(), "grows:user", []byte("3"))
+
+	messages := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case message := <-received:
+			messages[message] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout, received %v", messages)
+		}
+	}
+	if !messages["grows:all:clients=1"] || !messages["grows:room:a.b=2"] {
+		t.Fatalf("unexpected messages: %v", messages)
+	}
+	select {
+	case message := <-received:
+		t.Fatalf("received message of channel not subscribed: %s", message)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// channels can be added and removed
+	if err := subscription.Subscribe(context.Background(), "grows:user"); err != nil {
+		t.Fatal(err)
+	}
+	if err := subscription.Unsubscribe(context.Background(), "grows:room:*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := subscriber.Health(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_ = publisher.Publish(context.Background(), "grows:room:a", []byte("4"))
+	_ = publisher.Publish(context.Background(), "grows:user", []byte("5"))
+	select {
+	case message := <-received:
+		if message != "grows:user=5" {
+			t.Fatalf("unexpected message: %s", message)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+	}
+}
@@ -0,0 +1,372 @@
+// Package pgbroker provides a groWs Broker using PostgreSQL LISTEN/NOTIFY
+//
+// All groWs channels are multiplexed over a single Postgres notification channel, the groWs channel
+// is encoded in the notification. Payloads exceeding the NOTIFY limit of 8000 bytes are stored in a
+// spill-over table and only their row ID is sent with the notification.
+package pgbroker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	groWs "github.com/kesimo/grows"
+)
+
+const (
+	// DefaultChannel is the Postgres notification channel
+	DefaultChannel = "grows"
+	// DefaultTable is the spill-over table for large payloads
+	DefaultTable = "grows_broker_messages"
+	// DefaultRetention is the time spilled payloads are kept (nodes have to fetch them in this time)
+	DefaultRetention = time.Minute
+	// MinReconnectBackoff and MaxReconnectBackoff bound the wait time between reconnect attempts of the listener
+	MinReconnectBackoff = 100 * time.Millisecond
+	MaxReconnectBackoff = 30 * time.Second
+	// MaxNotifyPayload is the maximum size of a notification payload accepted by Postgres (exclusive)
+	MaxNotifyPayload = 8000
+)
+
+const (
+	kindInline  = 'm'
+	kindSpilled = 's'
+)
+
+// ErrInvalidNotification is returned if a notification was not sent by a Broker
+var ErrInvalidNotification = errors.New("pgbroker: invalid notification")
+
+// Options configures the Broker
+type Options struct {
+	// Channel is the Postgres notification channel (default: DefaultChannel)
+	Channel string
+	// Table is the spill-over table, created if it does not exist (default: DefaultTable)
+	Table string
+	// Retention of spilled payloads (default: DefaultRetention)
+	Retention time.Duration
+}
+
+// subscription is a handler subscribed to a set of channels
+type subscription struct {
+	broker  *Broker
+	handler groWs.MessageHandler
+	// channels are guarded by broker.mu
+	channels map[string]bool
+}
+
+// matches checks if the channel or a pattern matching it is subscribed (broker.mu must be held)
+func (s *subscription) matches(channel string) bool {
+	if s.channels[channel] {
+		return true
+	}
+	for c := range s.channels {
+		if strings.HasSuffix(c, "*") && strings.HasPrefix(channel, strings.TrimSuffix(c, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribe adds channels to the subscription
+func (s *subscription) Subscribe(_ context.Context, channels ...string) error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	for _, channel := range channels {
+		s.channels[channel] = true
+	}
+	return nil
+}
+
+// Unsubscribe removes channels from the subscription
+func (s *subscription) Unsubscribe(_ context.Context, channels ...string) error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	for _, channel := range channels {
+		delete(s.channels, channel)
+	}
+	return nil
+}
+
+// Close removes the subscription, the listener keeps running for other subscriptions
+func (s *subscription) Close() error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	for i, subscription := range s.broker.subscriptions {
+		if subscription == s {
+			s.broker.subscriptions = append(s.broker.subscriptions[:i], s.broker.subscriptions[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Broker is a groWs.Broker using Postgres LISTEN/NOTIFY
+type Broker struct {
+	pool    *pgxpool.Pool
+	options Options
+
+	mu            sync.RWMutex
+	subscriptions []*subscription
+	listener      *pgxpool.Conn
+	cancel        context.CancelFunc
+	done          chan struct{}
+}
+
+var _ groWs.Broker = (*Broker)(nil)
+
+// New creates a Broker using the pool (closed by Broker.Close) and creates the spill-over table
+func New(ctx context.Context, pool *pgxpool.Pool, options Options) (*Broker, error) {
+	if options.Channel == "" {
+		options.Channel = DefaultChannel
+	}
+	if options.Table == "" {
+		options.Table = DefaultTable
+	}
+	if options.Retention <= 0 {
+		options.Retention = DefaultRetention
+	}
+	b := &Broker{pool: pool, options: options}
+	_, err := pool.Exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		id BIGSERIAL PRIMARY KEY,
+		payload BYTEA NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`, b.table()))
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Connect connects to the database and creates a Broker
+func Connect(ctx context.Context, dsn string, options Options) (*Broker, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	b, err := New(ctx, pool, options)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// table returns the quoted name of the spill-over table
+func (b *Broker) table() string {
+	return pgx.Identifier(strings.Split(b.options.Table, ".")).Sanitize()
+}
+
+// Publish sends the payload with a notification, large payloads are stored in the spill-over table
+func (b *Broker) Publish(ctx context.Context, channel string, payload []byte) error {
+	notification := encode(kindInline, channel, payload)
+	if len(notification) >= MaxNotifyPayload || !utf8.Valid(payload) || strings.ContainsRune(string(payload), 0) {
+		id, err := b.spill(ctx, payload)
+		if err != nil {
+			return err
+		}
+		notification = encode(kindSpilled, channel, []byte(strconv.FormatInt(id, 10)))
+	}
+	_, err := b.pool.Exec(ctx, "SELECT pg_notify($1, $2)", b.options.Channel, notification)
+	return err
+}
+
+// spill stores the payload in the spill-over table and removes expired payloads
+func (b *Broker) spill(ctx context.Context, payload []byte) (int64, error) {
+	var id int64
+	err := b.pool.QueryRow(ctx, fmt.Sprintf("INSERT INTO %s (payload) VALUES ($1) RETURNING id", b.table()), payload).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	_, err = b.pool.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE created_at < now() - make_interval(secs => $1)", b.table()),
+		b.options.Retention.Seconds())
+	return id, err
+}
+
+// Subscribe calls the handler for notifications of the channels
+// The first call starts listening on the Postgres notification channel.
+func (b *Broker) Subscribe(ctx context.Context, handler groWs.MessageHandler, channels ...string) (groWs.Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cancel == nil {
+		conn, err := b.acquireListener(ctx)
+		if err != nil {
+			return nil, err
+		}
+		listenCtx, cancel := context.WithCancel(context.Background())
+		b.listener, b.cancel, b.done = conn, cancel, make(chan struct{})
+		go b.listen(listenCtx)
+	}
+	s := &subscription{broker: b, handler: handler, channels: make(map[string]bool, len(channels))}
+	for _, channel := range channels {
+		s.channels[channel] = true
+	}
+	b.subscriptions = append(b.subscriptions, s)
+	return s, nil
+}
+
+// acquireListener acquires a connection from the pool and listens on the notification channel
+func (b *Broker) acquireListener(ctx context.Context) (*pgxpool.Conn, error) {
+	conn, err := b.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{b.options.Channel}.Sanitize()); err != nil {
+		conn.Release()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// listen waits for notifications until the context is canceled
+// If the connection fails, it reconnects with exponential backoff (notifications sent meanwhile are lost)
+func (b *Broker) listen(ctx context.Context) {
+	defer close(b.done)
+	var backoff time.Duration
+	for {
+		b.mu.RLock()
+		conn := b.listener
+		b.mu.RUnlock()
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println("pgbroker: listen error: ", err)
+			if !b.reconnect(ctx, conn, &backoff) {
+				return
+			}
+			continue
+		}
+		backoff = 0
+		channel, payload, err := b.decode(ctx, notification.Payload)
+		if err != nil {
+			log.Println("pgbroker: ", err)
+			continue
+		}
+		b.mu.RLock()
+		handlers := make([]groWs.MessageHandler, 0, len(b.subscriptions))
+		for _, s := range b.subscriptions {
+			if s.matches(channel) {
+				handlers = append(handlers, s.handler)
+			}
+		}
+		b.mu.RUnlock()
+		// handled on the listener goroutine, so the notifications are handled in the order they are received
+		for _, handler := range handlers {
+			handler(channel, payload)
+		}
+	}
+}
+
+// reconnect replaces the failed listener connection, waiting with exponential backoff between the attempts
+// It returns false if the context was canceled
+func (b *Broker) reconnect(ctx context.Context, failed *pgxpool.Conn, backoff *time.Duration) bool {
+	b.mu.Lock()
+	b.listener = nil
+	b.mu.Unlock()
+	_ = failed.Conn().Close(context.Background())
+	failed.Release()
+	for {
+		*backoff *= 2
+		if *backoff < MinReconnectBackoff {
+			*backoff = MinReconnectBackoff
+		}
+		if *backoff > MaxReconnectBackoff {
+			*backoff = MaxReconnectBackoff
+		}
+		select {
+		case <-time.After(*backoff):
+		case <-ctx.Done():
+			return false
+		}
+		conn, err := b.acquireListener(ctx)
+		if err != nil {
+			log.Printf("pgbroker: reconnect failed, retrying in %s: %v", *backoff, err)
+			continue
+		}
+		b.mu.Lock()
+		b.listener = conn
+		b.mu.Unlock()
+		return true
+	}
+}
+
+// decode returns the channel and payload of a notification, fetching spilled payloads from the table
+func (b *Broker) decode(ctx context.Context, notification string) (string, []byte, error) {
+	kind, channel, payload, err := decode(notification)
+	if err != nil || kind == kindInline {
+		return channel, payload, err
+	}
+	id, err := strconv.ParseInt(string(payload), 10, 64)
+	if err != nil {
+		return "", nil, ErrInvalidNotification
+	}
+	err = b.pool.QueryRow(ctx, fmt.Sprintf("SELECT payload FROM %s WHERE id = $1", b.table()), id).Scan(&payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("spilled payload %d: %w", id, err)
+	}
+	return channel, payload, nil
+}
+
+// Health pings the database
+func (b *Broker) Health(ctx context.Context) error {
+	return b.pool.Ping(ctx)
+}
+
+// Close stops listening and closes the pool
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	cancel, done := b.cancel, b.done
+	b.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	b.mu.Lock()
+	listener := b.listener
+	b.listener = nil
+	b.subscriptions = nil
+	b.mu.Unlock()
+	if listener != nil {
+		// the connection is in an undefined state after canceling WaitForNotification
+		_ = listener.Conn().Close(context.Background())
+		listener.Release()
+	}
+	b.pool.Close()
+	return nil
+}
+
+// encode builds a notification: kind, length of the channel, ":", channel and payload (e.g. "m11:grows:user{...}")
+func encode(kind byte, channel string, payload []byte) string {
+	var sb strings.Builder
+	sb.WriteByte(kind)
+	sb.WriteString(strconv.Itoa(len(channel)))
+	sb.WriteByte(':')
+	sb.WriteString(channel)
+	sb.Write(payload)
+	return sb.String()
+}
+
+// decode parses a notification built by encode
+func decode(notification string) (byte, string, []byte, error) {
+	if len(notification) < 3 || (notification[0] != kindInline && notification[0] != kindSpilled) {
+		return 0, "", nil, ErrInvalidNotification
+	}
+	sep := strings.IndexByte(notification, ':')
+	if sep < 2 {
+		return 0, "", nil, ErrInvalidNotification
+	}
+	length, err := strconv.Atoi(notification[1:sep])
+	if err != nil || length < 0 || sep+1+length > len(notification) {
+		return 0, "", nil, ErrInvalidNotification
+	}
+	channel := notification[sep+1 : sep+1+length]
+	return notification[0], channel, []byte(notification[sep+1+length:]), nil
+}
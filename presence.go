@@ -0,0 +1,583 @@
+package groWs
+
+import (
+	json2 "encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cluster-wide presence of the clients
+// Every node publishes the changes of its clients and a snapshot every Config.PresenceInterval to the presence channel,
+// the other nodes keep a registry of the clients of all nodes.
+
+// DefaultPresenceInterval is the default interval the nodes publish their presence snapshot in
+const DefaultPresenceInterval = 10 * time.Second
+
+// Identifiers of the events sent to the clients of a room with presence events enabled (see EnableRoomPresence)
+const (
+	PresenceJoinEventIdentifier  = "presence.join"
+	PresenceLeaveEventIdentifier = "presence.leave"
+)
+
+// PresenceEventType is the type of a PresenceEvent
+type PresenceEventType string
+
+const (
+	// PresenceConnect is sent if a client connected to a node
+	PresenceConnect PresenceEventType = "connect"
+	// PresenceDisconnect is sent if a client disconnected (or its node is not reachable anymore)
+	PresenceDisconnect PresenceEventType = "disconnect"
+	// PresenceJoin is sent if a client joined a room
+	PresenceJoin PresenceEventType = "join"
+	// PresenceLeave is sent if a client left a room
+	PresenceLeave PresenceEventType = "leave"
+)
+
+// presence updates only exchanged between the nodes
+const (
+	// presenceSnapshot replaces all clients of the node
+	presenceSnapshot PresenceEventType = "snapshot"
+	// presenceSync requests a snapshot from all nodes
+	presenceSync PresenceEventType = "sync"
+	// presenceDown removes the node
+	presenceDown PresenceEventType = "down"
+)
+
+// PresenceClient is a client connected to a node of the cluster
+type PresenceClient struct {
+	ID     string   `json:"id"`
+	UserID string   `json:"user_id,omitempty"`
+	Tenant string   `json:"tenant,omitempty"`
+	Node   string   `json:"node"`
+	Rooms  []string `json:"rooms,omitempty"`
+}
+
+// PresenceEvent is a change of the presence of a client
+type PresenceEvent struct {
+	Type PresenceEventType `json:"type"`
+	// Room of join and leave events
+	Room   string         `json:"room,omitempty"`
+	Client PresenceClient `json:"client"`
+}
+
+// PresenceHandler is called for the presence events of all nodes
+type PresenceHandler func(event PresenceEvent)
+
+// presenceUpdate is published by a node to the presence channel
+// Epoch (the start time of the node) and Seq order the updates of a node, as they can be received out of order.
+type presenceUpdate struct {
+	Type    PresenceEventType `json:"type"`
+	Epoch   int64             `json:"epoch,omitempty"`
+	Seq     uint64            `json:"seq,omitempty"`
+	Room    string            `json:"room,omitempty"`
+	Client  *PresenceClient   `json:"client,omitempty"`
+	Clients []PresenceClient  `json:"clients,omitempty"`
+}
+
+// event returns the presence event of a client update
+func (u presenceUpdate) event() PresenceEvent {
+	return PresenceEvent{Type: u.Type, Room: u.Room, Client: *u.Client}
+}
+
+// after checks if the update was published after the update with the epoch and sequence number
+func (u presenceUpdate) after(epoch int64, seq uint64) bool {
+	return u.Epoch > epoch || (u.Epoch == epoch && u.Seq > seq)
+}
+
+// EnableRoomPresence sends a presence.join and presence.leave event (with a PresenceEvent as data)
+// to the clients of the room of the default app if a client joins or leaves it (see App.EnableRoomPresence)
+func EnableRoomPresence(roomId string) {
+	c, err := getPubSubClient()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	c.setRoomPresence(roomId, true)
+}
+
+// DisableRoomPresence stops sending presence events to the clients of the room of the default app
+func DisableRoomPresence(roomId string) {
+	c, err := getPubSubClient()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	c.setRoomPresence(roomId, false)
+}
+
+// EnableRoomPresence sends a presence.join and presence.leave event (with a PresenceEvent as data)
+// to the clients of the room if a client joins or leaves it
+// The events are sent by the node of the joining client, so it has to be called on every node (requires Config.EnablePresence).
+func (a *App) EnableRoomPresence(roomId string) {
+	a.pubsub.setRoomPresence(roomId, true)
+}
+
+// DisableRoomPresence stops sending presence events to the clients of the room
+func (a *App) DisableRoomPresence(roomId string) {
+	a.pubsub.setRoomPresence(roomId, false)
+}
+
+// setRoomPresence enables or disables the presence events of the room
+func (c *pubSubClient) setRoomPresence(roomId string, enabled bool) {
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+	if enabled {
+		c.presenceRooms[roomId] = true
+	} else {
+		delete(c.presenceRooms, roomId)
+	}
+}
+
+// hasRoomPresence checks if presence events are sent to the room
+func (c *pubSubClient) hasRoomPresence(roomId string) bool {
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+	return c.presenceRooms[roomId]
+}
+
+// nodePresence are the clients of a node
+type nodePresence struct {
+	clients map[string]*PresenceClient
+	seen    time.Time
+	// epoch and seq of the last applied update
+	epoch int64
+	seq   uint64
+}
+
+// presenceRegistry keeps the clients of the other nodes
+type presenceRegistry struct {
+	mu    sync.RWMutex
+	ttl   time.Duration
+	nodes map[string]*nodePresence
+	// down are the nodes removed by a presenceDown update, so updates received late do not add them again
+	down map[string]*nodePresence
+}
+
+func newPresenceRegistry(ttl time.Duration) *presenceRegistry {
+	return &presenceRegistry{ttl: ttl, nodes: make(map[string]*nodePresence), down: make(map[string]*nodePresence)}
+}
+
+// apply updates the clients of the node and returns the resulting presence events
+// Updates published before the last applied update (or before the node went down) are dropped,
+// events are only returned for actual changes (a snapshot returns the differences to the previous clients).
+func (r *presenceRegistry) apply(node string, update presenceUpdate, now time.Time) []PresenceEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	presence := r.nodes[node]
+	if presence == nil {
+		presence = r.down[node]
+	}
+	if presence != nil && !update.after(presence.epoch, presence.seq) {
+		return nil
+	}
+	if update.Type == presenceDown {
+		events := r.nodes[node].events()
+		delete(r.nodes, node)
+		r.down[node] = &nodePresence{seen: now, epoch: update.Epoch, seq: update.Seq}
+		return events
+	}
+	if presence == nil || r.nodes[node] == nil {
+		delete(r.down, node)
+		presence = &nodePresence{clients: make(map[string]*PresenceClient)}
+		r.nodes[node] = presence
+	}
+	presence.seen, presence.epoch, presence.seq = now, update.Epoch, update.Seq
+	if update.Client != nil {
+		update.Client.Node = node
+	}
+	switch update.Type {
+	case presenceSnapshot:
+		clients := make(map[string]*PresenceClient, len(update.Clients))
+		for i := range update.Clients {
+			update.Clients[i].Node = node
+			clients[update.Clients[i].ID] = &update.Clients[i]
+		}
+		events := presence.diff(clients)
+		presence.clients = clients
+		return events
+	case PresenceConnect:
+		if presence.clients[update.Client.ID] != nil {
+			return nil
+		}
+		client := *update.Client
+		presence.clients[client.ID] = &client
+	case PresenceDisconnect:
+		if presence.clients[update.Client.ID] == nil {
+			return nil
+		}
+		delete(presence.clients, update.Client.ID)
+	case PresenceJoin:
+		client := presence.clients[update.Client.ID]
+		if client == nil {
+			copied := *update.Client
+			client = &copied
+			presence.clients[client.ID] = client
+		}
+		if containsString(client.Rooms, update.Room) {
+			return nil
+		}
+		client.Rooms = append(client.Rooms, update.Room)
+	case PresenceLeave:
+		client := presence.clients[update.Client.ID]
+		if client == nil || !containsString(client.Rooms, update.Room) {
+			return nil
+		}
+		client.Rooms = removeString(client.Rooms, update.Room)
+	default:
+		return nil
+	}
+	return []PresenceEvent{update.event()}
+}
+
+// expire removes the nodes not seen within the ttl and returns the resulting presence events
+func (r *presenceRegistry) expire(now time.Time) []PresenceEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := make([]PresenceEvent, 0)
+	for node, presence := range r.nodes {
+		if now.Sub(presence.seen) > r.ttl {
+			log.Println("presence of node " + node + " expired")
+			events = append(events, presence.events()...)
+			delete(r.nodes, node)
+		}
+	}
+	for node, presence := range r.down {
+		if now.Sub(presence.seen) > r.ttl {
+			delete(r.down, node)
+		}
+	}
+	return events
+}
+
+// clients returns the clients of all nodes in the registry
+func (r *presenceRegistry) clients() []PresenceClient {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	clients := make([]PresenceClient, 0)
+	for _, presence := range r.nodes {
+		for _, client := range presence.clients {
+			copied := *client
+			copied.Rooms = append([]string(nil), client.Rooms...)
+			clients = append(clients, copied)
+		}
+	}
+	return clients
+}
+
+// nodeIDs returns the IDs of the nodes in the registry
+func (r *presenceRegistry) nodeIDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// events returns the leave and disconnect events of all clients of the node
+func (p *nodePresence) events() []PresenceEvent {
+	events := make([]PresenceEvent, 0)
+	if p == nil {
+		return events
+	}
+	for _, client := range p.clients {
+		for _, room := range client.Rooms {
+			events = append(events, PresenceEvent{Type: PresenceLeave, Room: room, Client: *client})
+		}
+		events = append(events, PresenceEvent{Type: PresenceDisconnect, Client: *client})
+	}
+	return events
+}
+
+// diff returns the events changing the clients of the node to the clients of a snapshot
+func (p *nodePresence) diff(clients map[string]*PresenceClient) []PresenceEvent {
+	events := make([]PresenceEvent, 0)
+	for id, client := range p.clients {
+		next := clients[id]
+		for _, room := range client.Rooms {
+			if next == nil || !containsString(next.Rooms, room) {
+				events = append(events, PresenceEvent{Type: PresenceLeave, Room: room, Client: *client})
+			}
+		}
+		if next == nil {
+			events = append(events, PresenceEvent{Type: PresenceDisconnect, Client: *client})
+		}
+	}
+	for id, client := range clients {
+		previous := p.clients[id]
+		if previous == nil {
+			events = append(events, PresenceEvent{Type: PresenceConnect, Client: *client})
+		}
+		for _, room := range client.Rooms {
+			if previous == nil || !containsString(previous.Rooms, room) {
+				events = append(events, PresenceEvent{Type: PresenceJoin, Room: room, Client: *client})
+			}
+		}
+	}
+	return events
+}
+
+// containsString checks if the list contains the value
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// removeString returns the list without the value
+func removeString(list []string, value string) []string {
+	for i, v := range list {
+		if v == value {
+			return append(list[:i:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+// presenceQueue is an unbounded queue of the updates of this node
+// The pool watcher enqueues updates while the pool is locked, so publishing them can not block it.
+type presenceQueue struct {
+	mu      sync.Mutex
+	updates []presenceUpdate
+	notify  chan struct{}
+}
+
+func newPresenceQueue() *presenceQueue {
+	return &presenceQueue{notify: make(chan struct{}, 1)}
+}
+
+// push adds an update to the queue
+func (q *presenceQueue) push(update presenceUpdate) {
+	q.mu.Lock()
+	q.updates = append(q.updates, update)
+	q.mu.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes all updates from the queue
+func (q *presenceQueue) pop() []presenceUpdate {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	updates := q.updates
+	q.updates = nil
+	return updates
+}
+
+// presenceClient returns the presence of a client of this node
+func (c *pubSubClient) presenceClient(client *Client) *PresenceClient {
+	return &PresenceClient{ID: client.GetID(), UserID: client.GetUserID(), Tenant: client.GetTenant(), Node: c.nodeID}
+}
+
+// enqueuePresence adds an update of this node to the presence queue (ignored if presence is disabled)
+func (c *pubSubClient) enqueuePresence(update presenceUpdate) {
+	if c.presenceQueue != nil {
+		c.presenceQueue.push(update)
+	}
+}
+
+// onPresence adds a handler called for the presence events of all nodes
+func (c *pubSubClient) onPresence(handler PresenceHandler) {
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+	c.presenceHandlers = append(c.presenceHandlers, handler)
+}
+
+// emitPresence calls the presence handlers
+func (c *pubSubClient) emitPresence(events []PresenceEvent) {
+	c.presenceMu.Lock()
+	handlers := c.presenceHandlers
+	c.presenceMu.Unlock()
+	for _, event := range events {
+		for _, handler := range handlers {
+			handler(event)
+		}
+	}
+}
+
+// runPresence publishes the presence updates of this node and a snapshot every interval
+// and removes the nodes not seen for three intervals
+func (c *pubSubClient) runPresence(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	c.enqueuePresence(presenceUpdate{Type: presenceSnapshot})
+	c.enqueuePresence(presenceUpdate{Type: presenceSync})
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.presenceQueue.notify:
+			for _, update := range c.presenceQueue.pop() {
+				c.publishPresence(update)
+			}
+		case now := <-ticker.C:
+			c.enqueuePresence(presenceUpdate{Type: presenceSnapshot})
+			c.emitPresence(c.presence.expire(now))
+		}
+	}
+}
+
+// publishPresence handles an update of this node and publishes it to the other nodes
+func (c *pubSubClient) publishPresence(update presenceUpdate) {
+	switch update.Type {
+	case presenceSnapshot:
+		// the snapshot contains all updates published before
+		update.Clients = c.pool.presence(c.nodeID)
+	case PresenceConnect, PresenceDisconnect, PresenceJoin, PresenceLeave:
+		event := update.event()
+		c.emitPresence([]PresenceEvent{event})
+		if event.Room != "" && c.hasRoomPresence(event.Room) {
+			c.sendRoomPresence(event)
+		}
+	}
+	data, err := json2.Marshal(c.sequence(update))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	_ = c.publish(Payload{Kind: PayloadPresence, Message: data})
+}
+
+// sequence sets the epoch and the next sequence number of this node on the update
+func (c *pubSubClient) sequence(update presenceUpdate) presenceUpdate {
+	update.Epoch = c.presenceEpoch
+	update.Seq = atomic.AddUint64(&c.presenceSeq, 1)
+	return update
+}
+
+// sendRoomPresence sends the join or leave event to the clients of the room
+func (c *pubSubClient) sendRoomPresence(event PresenceEvent) {
+	identifier := PresenceJoinEventIdentifier
+	if event.Type == PresenceLeave {
+		identifier = PresenceLeaveEventIdentifier
+	}
+	client := event.Client
+	client.Rooms = nil
+	json, err := c.envelope.Marshal(Event{Identifier: identifier, Data: PresenceEvent{Type: event.Type, Room: event.Room, Client: client}})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	_ = c.publish(Payload{Kind: PayloadRoom, Tenant: event.Client.Tenant, Id: event.Room, Message: json})
+}
+
+// receivePresence applies the presence update of another node
+func (c *pubSubClient) receivePresence(payload Payload) {
+	if c.presence == nil {
+		return
+	}
+	update := presenceUpdate{}
+	if err := json2.Unmarshal(payload.Message, &update); err != nil {
+		log.Println("invalid presence update of node " + payload.Origin + ": " + err.Error())
+		return
+	}
+	if update.Type == presenceSync {
+		c.enqueuePresence(presenceUpdate{Type: presenceSnapshot})
+		return
+	}
+	if update.Client == nil && update.Type != presenceSnapshot && update.Type != presenceDown {
+		return
+	}
+	c.emitPresence(c.presence.apply(payload.Origin, update, time.Now()))
+}
+
+// clusterPresence returns the clients of this node and of all other nodes in the presence registry
+func (c *pubSubClient) clusterPresence() []PresenceClient {
+	clients := c.pool.presence(c.nodeID)
+	if c.presence != nil {
+		clients = append(clients, c.presence.clients()...)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Node != clients[j].Node {
+			return clients[i].Node < clients[j].Node
+		}
+		return clients[i].ID < clients[j].ID
+	})
+	return clients
+}
+
+// GetOnlineClients returns the clients of the default app connected to any node of the cluster
+// Without Config.EnablePresence, only the clients of this node are returned.
+func GetOnlineClients() []PresenceClient {
+	c, err := getPubSubClient()
+	if err != nil {
+		log.Println(err)
+		return []PresenceClient{}
+	}
+	return c.clusterPresence()
+}
+
+// GetOnlineClients returns the clients of the app connected to any node of the cluster
+func (a *App) GetOnlineClients() []PresenceClient {
+	return a.pubsub.clusterPresence()
+}
+
+// GetOnlineUsers returns the IDs of the users with a client connected to any node of the cluster
+func GetOnlineUsers() []string {
+	users := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, client := range GetOnlineClients() {
+		if client.UserID != "" && !seen[client.UserID] {
+			seen[client.UserID] = true
+			users = append(users, client.UserID)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// GetUserPresence returns the clients of a user connected to any node of the cluster
+func GetUserPresence(userID string) []PresenceClient {
+	clients := make([]PresenceClient, 0)
+	for _, client := range GetOnlineClients() {
+		if client.UserID == userID {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// GetRoomPresence returns the clients in a room on any node of the cluster (of all tenants, see PresenceClient.Tenant)
+func GetRoomPresence(roomId string) []PresenceClient {
+	clients := make([]PresenceClient, 0)
+	for _, client := range GetOnlineClients() {
+		if containsString(client.Rooms, roomId) {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// GetNodes returns the IDs of all nodes of the cluster known to this node (including this node)
+func GetNodes() []string {
+	c, err := getPubSubClient()
+	if err != nil {
+		log.Println(err)
+		return []string{}
+	}
+	return c.nodes()
+}
+
+// GetNodes returns the IDs of all nodes of the cluster of the app known to this node (including this node)
+func (a *App) GetNodes() []string {
+	return a.pubsub.nodes()
+}
+
+// nodes returns the IDs of this node and the nodes in the presence registry
+func (c *pubSubClient) nodes() []string {
+	nodes := []string{c.nodeID}
+	if c.presence != nil {
+		nodes = append(nodes, c.presence.nodeIDs()...)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
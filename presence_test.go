@@ -0,0 +1,199 @@
+package groWs
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor polls the condition until it is true or the timeout is reached
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// buffered returns the messages buffered for the client
+func buffered(client *Client) [][]byte {
+	client.connMu.Lock()
+	defer client.connMu.Unlock()
+	return client.buffer
+}
+
+// presenceIds returns the ids of the clients
+func presenceIds(clients []PresenceClient) string {
+	ids := make([]string, 0, len(clients))
+	for _, client := range clients {
+		ids = append(ids, client.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestPresenceRegistry(t *testing.T) {
+	registry := newPresenceRegistry(time.Second)
+	now := time.Now()
+	a := PresenceClient{ID: "a", UserID: "u"}
+	events := registry.apply("n1", presenceUpdate{Type: PresenceConnect, Seq: 1, Client: &a}, now)
+	if len(events) != 1 || events[0].Type != PresenceConnect || events[0].Client.Node != "n1" {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	registry.apply("n1", presenceUpdate{Type: PresenceJoin, Seq: 2, Room: "r", Client: &PresenceClient{ID: "a"}}, now)
+	events = registry.apply("n2", presenceUpdate{Type: presenceSnapshot, Seq: 1, Clients: []PresenceClient{{ID: "b", Rooms: []string{"r"}}}}, now)
+	if len(events) != 2 || events[0].Type != PresenceConnect || events[1].Type != PresenceJoin {
+		t.Fatalf("expected connect and join events of the snapshot, got %+v", events)
+	}
+
+	// a connect published after a snapshot containing the client keeps its rooms and is no change
+	if events := registry.apply("n2", presenceUpdate{Type: PresenceConnect, Seq: 2, Client: &PresenceClient{ID: "b"}}, now); len(events) != 0 {
+		t.Errorf("expected no events for a connected client, got %+v", events)
+	}
+	clients := registry.clients()
+	if len(clients) != 2 {
+		t.Fatalf("unexpected clients %+v", clients)
+	}
+	for _, client := range clients {
+		if len(client.Rooms) != 1 || client.Rooms[0] != "r" {
+			t.Errorf("unexpected rooms of %+v", client)
+		}
+	}
+
+	// updates received out of order are dropped
+	if events := registry.apply("n1", presenceUpdate{Type: PresenceLeave, Seq: 4, Room: "r", Client: &PresenceClient{ID: "a"}}, now); len(events) != 1 {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	if events := registry.apply("n1", presenceUpdate{Type: PresenceJoin, Seq: 3, Room: "r", Client: &PresenceClient{ID: "a"}}, now); len(events) != 0 {
+		t.Errorf("expected stale join to be dropped, got %+v", events)
+	}
+	if events := registry.apply("n1", presenceUpdate{Type: PresenceDisconnect, Seq: 5, Client: &PresenceClient{ID: "x"}}, now); len(events) != 0 {
+		t.Errorf("expected no events for an unknown client, got %+v", events)
+	}
+
+	// nodes not seen within the ttl are removed with leave and disconnect events
+	registry.apply("n1", presenceUpdate{Type: presenceSnapshot, Seq: 6, Clients: []PresenceClient{{ID: "a", Rooms: []string{"r"}}}}, now.Add(time.Second))
+	events = registry.expire(now.Add(1500 * time.Millisecond))
+	if len(events) != 2 || events[0].Type != PresenceLeave || events[0].Client.ID != "b" || events[1].Type != PresenceDisconnect {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	if nodes := registry.nodeIDs(); len(nodes) != 1 || nodes[0] != "n1" {
+		t.Fatalf("unexpected nodes %v", nodes)
+	}
+
+	// updates received after the node went down do not add it again, a restarted node (new epoch) is added
+	registry.apply("n1", presenceUpdate{Type: presenceDown, Seq: 8}, now)
+	if events := registry.apply("n1", presenceUpdate{Type: PresenceConnect, Seq: 7, Client: &a}, now); len(events) != 0 || len(registry.nodeIDs()) != 0 {
+		t.Errorf("expected late update to be dropped, got %+v", events)
+	}
+	if events := registry.apply("n1", presenceUpdate{Type: PresenceConnect, Epoch: 1, Seq: 1, Client: &a}, now); len(events) != 1 || len(registry.nodeIDs()) != 1 {
+		t.Errorf("expected restarted node to be added, got %+v", events)
+	}
+}
+
+func TestClusterPresence(t *testing.T) {
+	cluster := newTestClusterWithConfig(t, 2, Config{EnablePresence: true, PresenceInterval: 20 * time.Millisecond})
+	var mu sync.Mutex
+	events := make([]string, 0)
+	cluster[0].pubsub.onPresence(func(event PresenceEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, string(event.Type)+":"+event.Client.ID+":"+event.Room)
+	})
+	for _, node := range cluster {
+		node.app.EnableRoomPresence("r")
+	}
+
+	cluster[0].addClient("a1", "u1", "r")
+	cluster[1].addClient("b1", "u2", "r")
+	cluster[1].addClient("b2", "u2")
+	waitFor(t, func() bool { return presenceIds(GetOnlineClients()) != "a1" && len(GetOnlineClients()) == 3 })
+	if got := presenceIds(GetRoomPresence("r")); got != "a1,b1" && got != "b1,a1" {
+		t.Errorf("unexpected room presence %q", got)
+	}
+	if got := strings.Join(GetOnlineUsers(), ","); got != "u1,u2" {
+		t.Errorf("unexpected users %q", got)
+	}
+	if got := presenceIds(GetUserPresence("u2")); got != "b1,b2" {
+		t.Errorf("unexpected user presence %q", got)
+	}
+	if len(GetNodes()) != 2 {
+		t.Errorf("unexpected nodes %v", GetNodes())
+	}
+	mu.Lock()
+	if !strings.Contains(strings.Join(events, ","), "join:b1:r") {
+		t.Errorf("expected join event of b1, got %v", events)
+	}
+	mu.Unlock()
+
+	// the clients in the room receive the presence events of the room
+	a1 := cluster[0].clients["a1"]
+	// (its own join and the join of b1)
+	waitFor(t, func() bool { return len(buffered(a1)) == 2 })
+	if event, err := FromJSON(buffered(a1)[1]); err != nil || event.Identifier != PresenceJoinEventIdentifier {
+		t.Fatalf("unexpected event %+v (%v)", event, err)
+	}
+	cluster[1].pool.RemoveClientFromRoom(cluster[1].clients["b1"], "r")
+	waitFor(t, func() bool { return len(buffered(a1)) == 3 })
+	event, err := FromJSON(buffered(a1)[2])
+	if err != nil || event.Identifier != PresenceLeaveEventIdentifier {
+		t.Fatalf("unexpected event %+v (%v)", event, err)
+	}
+
+	// stopped nodes are removed from the registry
+	cluster[1].pubsub.stop()
+	waitFor(t, func() bool { return presenceIds(GetOnlineClients()) == "a1" })
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(strings.Join(events, ","), "disconnect:b2:") {
+		t.Errorf("expected disconnect event of b2, got %v", events)
+	}
+}
+
+func TestClusterPresenceOrderedUpdates(t *testing.T) {
+	// nodes connected through Redis Pub/Sub without periodic snapshots, so dropped updates are not repaired
+	mr := miniredis.RunT(t)
+	nodes := make([]*pubSubClient, 2)
+	for i := range nodes {
+		broker := NewRedisBroker(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+		t.Cleanup(func() { _ = broker.Close() })
+		pubsub, err := newPubSubClient(context.Background(), newClientPool(), Config{Broker: broker, NodeID: "node-" + strconv.Itoa(i),
+			EnablePresence: true, PresenceInterval: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(pubsub.cancel)
+		nodes[i] = pubsub
+	}
+	client := newTestClient("a", "/", nil, time.Now())
+	client.bufferSize = 10
+	nodes[0].pool.AddClient(client)
+	want := make([]string, 0)
+	for i := 0; i < 100; i++ {
+		room := "r" + strconv.Itoa(i)
+		nodes[0].pool.AddClientToRoom(client, room)
+		if i%2 == 1 {
+			nodes[0].pool.RemoveClientFromRoom(client, room)
+		} else {
+			want = append(want, room)
+		}
+	}
+	sort.Strings(want)
+	waitFor(t, func() bool {
+		clients := nodes[1].presence.clients()
+		if len(clients) != 1 {
+			return false
+		}
+		rooms := append([]string{}, clients[0].Rooms...)
+		sort.Strings(rooms)
+		return strings.Join(rooms, ",") == strings.Join(want, ",")
+	})
+}
@@ -0,0 +1,177 @@
+// Package publisher sends messages to the clients of groWs nodes from services without App (e.g. REST APIs or workers)
+//
+// A Publisher publishes the same payloads to the same broker channels as the nodes, so it has to use the same
+// broker, ChannelPrefix, RoomShards and EventEnvelope as the App:
+//
+//	broker := groWs.NewRedisBroker(redis.NewClient(&redis.Options{Addr: "localhost:6379"}))
+//	p := publisher.New(broker, publisher.Options{})
+//	err := p.BroadcastEvent(ctx, "orders", groWs.Event{Identifier: "order.updated", Data: order})
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/google/uuid"
+	groWs "github.com/kesimo/grows"
+)
+
+// Options configures a Publisher
+type Options struct {
+	// ChannelPrefix of the app (default: groWs.DefaultChannelPrefix)
+	ChannelPrefix string
+	// RoomShards of the app (see groWs.Config.RoomShards)
+	RoomShards int
+	// ID is sent as origin of the payloads (default: random UUID), it must not be the ID of a node
+	ID string
+	// EventEnvelope of the app used to encode events (see groWs.Config.EventEnvelope, default: groWs.DefaultEventEnvelope)
+	EventEnvelope groWs.EventEnvelope
+}
+
+// Publisher publishes messages to the clients connected to any node
+// Delivery is not confirmed, like the broadcasts of the nodes. The methods return when the broker accepted
+// the message or the context is done.
+type Publisher struct {
+	broker   groWs.Broker
+	channels groWs.Channels
+	id       string
+	tenant   string
+	envelope groWs.EventEnvelope
+}
+
+// New creates a Publisher using the broker
+func New(broker groWs.Broker, options Options) *Publisher {
+	if options.ChannelPrefix == "" {
+		options.ChannelPrefix = groWs.DefaultChannelPrefix
+	}
+	if options.ID == "" {
+		options.ID = uuid.NewString()
+	}
+	return &Publisher{
+		broker:   broker,
+		channels: groWs.Channels{Prefix: options.ChannelPrefix, RoomShards: options.RoomShards},
+		id:       options.ID,
+		envelope: options.EventEnvelope.WithDefaults(),
+	}
+}
+
+// Tenant returns a Publisher sending to the clients of the tenant (see groWs.Tenant)
+func (p *Publisher) Tenant(tenant string) *Publisher {
+	copied := *p
+	copied.tenant = tenant
+	return &copied
+}
+
+// Close closes the broker
+func (p *Publisher) Close() error {
+	return p.broker.Close()
+}
+
+// publish sends the payload to its channel
+func (p *Publisher) publish(ctx context.Context, payload groWs.Payload) error {
+	payload.Origin = p.id
+	payload.Tenant = p.tenant
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return p.broker.Publish(ctx, p.channels.Of(payload), data)
+}
+
+// publishEvent encodes the event with the envelope and sends it with the payload
+func (p *Publisher) publishEvent(ctx context.Context, payload groWs.Payload, event groWs.Event) error {
+	data, err := p.envelope.Marshal(event)
+	if err != nil {
+		return err
+	}
+	payload.Message = data
+	return p.publish(ctx, payload)
+}
+
+// Broadcast sends a Message to all clients in a room
+func (p *Publisher) Broadcast(ctx context.Context, roomId string, message []byte) error {
+	return p.publish(ctx, groWs.Payload{Kind: groWs.PayloadRoom, Id: roomId, Message: message})
+}
+
+// BroadcastEvent sends an event to all clients in a room
+func (p *Publisher) BroadcastEvent(ctx context.Context, roomId string, event groWs.Event) error {
+	return p.publishEvent(ctx, groWs.Payload{Kind: groWs.PayloadRoom, Id: roomId}, event)
+}
+
+// BroadcastToAll sends a Message to all clients
+func (p *Publisher) BroadcastToAll(ctx context.Context, message []byte) error {
+	return p.publish(ctx, groWs.Payload{Kind: groWs.PayloadAll, Message: message})
+}
+
+// BroadcastEventToAll sends an event to all clients
+func (p *Publisher) BroadcastEventToAll(ctx context.Context, event groWs.Event) error {
+	return p.publishEvent(ctx, groWs.Payload{Kind: groWs.PayloadAll}, event)
+}
+
+// BroadcastByFilter sends a Message to all clients matching the metadata filter
+func (p *Publisher) BroadcastByFilter(ctx context.Context, filter groWs.MetaFilter, message []byte) error {
+	return p.publish(ctx, groWs.Payload{Kind: groWs.PayloadMeta, Filter: filter, Message: message})
+}
+
+// BroadcastEventByFilter sends an event to all clients matching the metadata filter
+func (p *Publisher) BroadcastEventByFilter(ctx context.Context, filter groWs.MetaFilter, event groWs.Event) error {
+	return p.publishEvent(ctx, groWs.Payload{Kind: groWs.PayloadMeta, Filter: filter}, event)
+}
+
+// SendToClient sends a Message to the client with the given Id
+func (p *Publisher) SendToClient(ctx context.Context, id string, message []byte) error {
+	return p.publish(ctx, groWs.Payload{Kind: groWs.PayloadClient, Id: id, Message: message})
+}
+
+// SendEventToClient sends an event to the client with the given Id
+func (p *Publisher) SendEventToClient(ctx context.Context, id string, event groWs.Event) error {
+	return p.publishEvent(ctx, groWs.Payload{Kind: groWs.PayloadClient, Id: id}, event)
+}
+
+// SendToUser sends a Message to all clients of a user
+func (p *Publisher) SendToUser(ctx context.Context, userID string, message []byte) error {
+	return p.publish(ctx, groWs.Payload{Kind: groWs.PayloadUser, Id: userID, Message: message})
+}
+
+// SendEventToUser sends an event to all clients of a user
+func (p *Publisher) SendEventToUser(ctx context.Context, userID string, event groWs.Event) error {
+	return p.publishEvent(ctx, groWs.Payload{Kind: groWs.PayloadUser, Id: userID}, event)
+}
+
+// DisconnectUser closes the connections of all clients of a user
+func (p *Publisher) DisconnectUser(ctx context.Context, userID string) error {
+	return p.publish(ctx, groWs.Payload{Kind: groWs.PayloadDisconnectUser, Id: userID})
+}
+
+// sendCommand publishes the control command to the node holding the connection of the client
+func (p *Publisher) sendCommand(ctx context.Context, id string, command groWs.ControlCommand) error {
+	data, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	return p.publish(ctx, groWs.Payload{Kind: groWs.PayloadControl, Id: id, Message: data})
+}
+
+// Disconnect closes the connection of the client (see groWs.Namespace.Disconnect)
+func (p *Publisher) Disconnect(ctx context.Context, id string) error {
+	return p.sendCommand(ctx, id, groWs.ControlCommand{Command: groWs.CommandDisconnect})
+}
+
+// JoinRoom adds the client to the room (see groWs.Namespace.JoinRoom)
+func (p *Publisher) JoinRoom(ctx context.Context, id string, roomId string) error {
+	return p.sendCommand(ctx, id, groWs.ControlCommand{Command: groWs.CommandJoinRoom, Room: roomId})
+}
+
+// LeaveRoom removes the client from the room (see groWs.Namespace.LeaveRoom)
+func (p *Publisher) LeaveRoom(ctx context.Context, id string, roomId string) error {
+	return p.sendCommand(ctx, id, groWs.ControlCommand{Command: groWs.CommandLeaveRoom, Room: roomId})
+}
+
+// SetMeta sets metadata of the client (see groWs.Namespace.SetMeta)
+func (p *Publisher) SetMeta(ctx context.Context, id string, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return p.sendCommand(ctx, id, groWs.ControlCommand{Command: groWs.CommandSetMeta, Key: key, Value: data})
+}
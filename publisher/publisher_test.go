@@ -0,0 +1,147 @@
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	groWs "github.com/kesimo/grows"
+)
+
+func TestPublisher(t *testing.T) {
+	ctx := context.Background()
+	broker := groWs.NewMemoryBroker()
+	channels := make([]string, 0)
+	payloads := make([]groWs.Payload, 0)
+	_, _ = broker.Subscribe(context.Background(), func(channel string, data []byte) {
+		payload := groWs.Payload{}
+		if err := json.Unmarshal(data, &payload); err != nil {
+			t.Fatal(err)
+		}
+		channels = append(channels, channel)
+		payloads = append(payloads, payload)
+	}, "app:*")
+	p := New(broker, Options{ChannelPrefix: "app", ID: "api"})
+
+	_ = p.BroadcastEvent(ctx, "orders", groWs.Event{Identifier: "order.updated", Data: 42})
+	_ = p.SendToClient(ctx, "c1", []byte("hi"))
+	_ = p.Tenant("acme").SendEventToUser(ctx, "u1", groWs.Event{Identifier: "e"})
+	_ = p.DisconnectUser(ctx, "u2")
+
+	want := "app:room:orders,app:client,app:tenant:acme:user,app:user:disconnect"
+	if got := strings.Join(channels, ","); got != want {
+		t.Fatalf("published to %q, want %q", got, want)
+	}
+	if payloads[0].Kind != groWs.PayloadRoom || payloads[0].Id != "orders" || payloads[0].Origin != "api" {
+		t.Errorf("unexpected payload %+v", payloads[0])
+	}
+	if event, err := groWs.FromJSON(payloads[0].Message); err != nil || event.Identifier != "order.updated" {
+		t.Errorf("unexpected event %+v (%v)", event, err)
+	}
+	if payloads[2].Tenant != "acme" || payloads[2].Kind != groWs.PayloadUser || payloads[1].Tenant != "" {
+		t.Errorf("unexpected tenants %+v", payloads)
+	}
+}
+
+func TestPublisherRoomShards(t *testing.T) {
+	ctx := context.Background()
+	broker := groWs.NewMemoryBroker()
+	var channel string
+	_, _ = broker.Subscribe(context.Background(), func(c string, _ []byte) {
+		channel = c
+	}, "grows:*")
+	p := New(broker, Options{RoomShards: 8})
+	_ = p.Broadcast(ctx, "lobby", []byte("hi"))
+	if want := (groWs.Channels{Prefix: "grows", RoomShards: 8}).Room("", "lobby"); channel != want {
+		t.Fatalf("published to %q, want %q", channel, want)
+	}
+}
+
+func TestPublisherEventEnvelope(t *testing.T) {
+	ctx := context.Background()
+	broker := groWs.NewMemoryBroker()
+	var message []byte
+	_, _ = broker.Subscribe(context.Background(), func(_ string, data []byte) {
+		payload := groWs.Payload{}
+		if err := json.Unmarshal(data, &payload); err != nil {
+			t.Fatal(err)
+		}
+		message = payload.Message
+	}, "grows:*")
+	envelope := groWs.EventEnvelope{IdentifierField: "type"}
+	p := New(broker, Options{EventEnvelope: envelope})
+	_ = p.BroadcastEventToAll(ctx, groWs.Event{Identifier: "order.updated", Data: 42})
+	event, err := groWs.EventEnvelope{IdentifierField: "type", DataField: "data"}.Parse(message)
+	if err != nil || event.Identifier != "order.updated" || event.Data != float64(42) {
+		t.Fatalf("unexpected event %s (%v)", message, err)
+	}
+}
+
+func TestPublisherControlCommands(t *testing.T) {
+	ctx := context.Background()
+	broker := groWs.NewMemoryBroker()
+	app, err := groWs.NewApp(groWs.Config{Broker: broker, ChannelPrefix: "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, conn := net.Pipe()
+	closed := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+	client := groWs.NewClient(server, nil)
+	app.GetClientPool().AddClient(client)
+	p := New(broker, Options{ChannelPrefix: "app"})
+
+	if err := p.JoinRoom(ctx, client.GetID(), "lobby"); err != nil {
+		t.Fatal(err)
+	}
+	if rooms := client.GetRooms(); len(rooms) != 1 || rooms[0] != "lobby" {
+		t.Fatalf("expected the client in the room, got %v", rooms)
+	}
+	if err := p.SetMeta(ctx, client.GetID(), "plan", "pro"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := client.GetMeta("plan"); err != nil || value != "pro" {
+		t.Fatalf("unexpected meta %v (%v)", value, err)
+	}
+	if err := p.LeaveRoom(ctx, client.GetID(), "lobby"); err != nil {
+		t.Fatal(err)
+	}
+	if rooms := client.GetRooms(); len(rooms) != 0 {
+		t.Fatalf("expected the client to leave the room, got %v", rooms)
+	}
+	if err := p.Disconnect(ctx, client.GetID()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+// blockingBroker is a MemoryBroker whose Publish blocks until the context is done
+type blockingBroker struct {
+	*groWs.MemoryBroker
+}
+
+func (b *blockingBroker) Publish(ctx context.Context, _ string, _ []byte) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestPublisherContext(t *testing.T) {
+	p := New(&blockingBroker{groWs.NewMemoryBroker()}, Options{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.BroadcastEventToAll(ctx, groWs.Event{Identifier: "e"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the publish to time out, got %v", err)
+	}
+}
@@ -0,0 +1,323 @@
+package groWs
+
+import (
+	"context"
+	json2 "encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// pub/sub client delivering messages to the clients of all nodes using a Broker
+
+var (
+	// pubSubClientInternal is the client of the default app used by the package-level functions (see NewApp)
+	pubSubClientInternal *pubSubClient
+	// pubSubOwned reports if the default app was created by NewApp
+	pubSubOwned    bool
+	pubSubMu       sync.Mutex
+	ErrPubSubIsNil = errors.New("pub/sub client is nil")
+	// ErrNodeIDRequired is returned if a pub/sub client is created without node ID
+	ErrNodeIDRequired = errors.New("pub/sub client requires a node id")
+)
+
+// DefaultChannelPrefix is the default prefix of all broker channels
+const DefaultChannelPrefix = "grows"
+
+// Payload kinds define the recipients of a Payload
+const (
+	// PayloadClient delivers the message to the client with the ID
+	PayloadClient = "client"
+	// PayloadRoom delivers the message to all clients in the room with the ID
+	PayloadRoom = "room"
+	// PayloadAll delivers the message to all clients (except the client with the ID in Except)
+	PayloadAll = "all"
+	// PayloadUser delivers the message to all clients of the user with the ID
+	PayloadUser = "user"
+	// PayloadMeta delivers the message to all clients matching the Filter
+	PayloadMeta = "meta"
+	// PayloadDisconnectUser closes the connections of all clients of the user with the ID
+	PayloadDisconnectUser = "disconnect_user"
+	// PayloadControl executes the command in the Message for the client with the ID (see Namespace.Disconnect)
+	PayloadControl = "control"
+	// PayloadPresence updates the presence registry of the nodes (not delivered to clients)
+	PayloadPresence = "presence"
+)
+
+// Payload is published to the broker and delivered by every node to its local clients
+// Events are encoded before publishing, so all nodes deliver the same bytes.
+type Payload struct {
+	Kind string `json:"kind"`
+	// Origin is the ID of the publishing node, that delivers the message to its clients before publishing
+	Origin string `json:"origin,omitempty"`
+	// Node is the ID of the only node delivering the message (empty = all nodes)
+	Node string `json:"node,omitempty"`
+	// Tenant of the recipients (only clients of the tenant receive the message, see Client.SetTenant)
+	Tenant  string     `json:"tenant,omitempty"`
+	Id      string     `json:"Id"`
+	Except  string     `json:"except,omitempty"`
+	Filter  MetaFilter `json:"filter,omitempty"`
+	Message []byte     `json:"Message"`
+}
+
+func (p *Payload) toJsonString() string {
+	json, _ := json2.Marshal(p)
+	return string(json)
+}
+
+func (p *Payload) fromJsonString(json string) error {
+	return json2.Unmarshal([]byte(json), p)
+}
+
+type pubSubClient struct {
+	broker Broker
+	// pool of the clients connected to this node
+	pool *ClientPool
+	// ID of this node
+	nodeID string
+	// channels of the payloads
+	channels Channels
+	// envelope of the events sent to the clients (see Config.EventEnvelope)
+	envelope EventEnvelope
+	// publishTimeout bounds the time of a publish to the broker (not positive = no timeout)
+	publishTimeout time.Duration
+	subscriptions  *subscriptions
+	ctx            context.Context
+	cancel         context.CancelFunc
+	handler        MessageHandler
+	// cluster presence, nil if disabled
+	presence         *presenceRegistry
+	presenceQueue    *presenceQueue
+	presenceMu       sync.Mutex
+	presenceHandlers []PresenceHandler
+	// presenceRooms are the rooms receiving presence events (see App.EnableRoomPresence)
+	presenceRooms map[string]bool
+	// presenceEpoch (the start time of this node) and presenceSeq order the presence updates of this node
+	presenceEpoch int64
+	presenceSeq   uint64
+	// broker state, updated by publish errors and the health checks
+	stateMu       sync.Mutex
+	state         BrokerState
+	stateErr      error
+	stateHandlers []BrokerStateHandler
+}
+
+// getPubSubClient returns the pub/sub client of the default app
+// If NewApp was not called yet, an app with the default config (using an in-process MemoryBroker) is created
+func getPubSubClient() (*pubSubClient, error) {
+	pubSubMu.Lock()
+	client := pubSubClientInternal
+	pubSubMu.Unlock()
+	if client != nil {
+		return client, nil
+	}
+	app, err := newApp(Config{}, false)
+	if err != nil {
+		return nil, err
+	}
+	return app.pubsub, nil
+}
+
+// newPubSubClient creates a pub/sub client delivering messages to the pool and subscribes to all channels
+// The broker health is checked every config.BrokerHealthInterval (disabled if not positive)
+func newPubSubClient(ctx context.Context, pool *ClientPool, config Config) (*pubSubClient, error) {
+	if config.Broker == nil {
+		return nil, ErrPubSubIsNil
+	}
+	if config.ChannelPrefix == "" {
+		config.ChannelPrefix = DefaultChannelPrefix
+	}
+	if config.NodeID == "" {
+		return nil, ErrNodeIDRequired
+	}
+	if config.BrokerPublishTimeout == 0 {
+		config.BrokerPublishTimeout = DefaultBrokerPublishTimeout
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	client := &pubSubClient{
+		broker:         config.Broker,
+		pool:           pool,
+		nodeID:         config.NodeID,
+		channels:       Channels{Prefix: config.ChannelPrefix, RoomShards: config.RoomShards},
+		envelope:       config.EventEnvelope.WithDefaults(),
+		publishTimeout: config.BrokerPublishTimeout,
+		presenceRooms:  make(map[string]bool),
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+	client.handler = client.handleIncomingMessages()
+	if config.EnablePresence {
+		if config.PresenceInterval <= 0 {
+			config.PresenceInterval = DefaultPresenceInterval
+		}
+		client.presence = newPresenceRegistry(3 * config.PresenceInterval)
+		client.presenceQueue = newPresenceQueue()
+		client.presenceEpoch = time.Now().UnixNano()
+	}
+	if err := client.StartSubscribing(); err != nil {
+		cancel()
+		return nil, err
+	}
+	// subscribe to the rooms and tenants of the clients in the pool and follow its changes
+	pool.setWatcher(client)
+	if config.BrokerHealthInterval > 0 {
+		go client.monitor(config.BrokerHealthInterval)
+	}
+	if client.presence != nil {
+		go client.runPresence(config.PresenceInterval)
+	}
+	return client, nil
+}
+
+// StartSubscribing subscribes to the channels of the default namespace
+// Room and tenant channels are subscribed when the first local client needs them
+func (c *pubSubClient) StartSubscribing() error {
+	subscription, err := c.broker.Subscribe(c.ctx, c.handler, c.baseChannels("")...)
+	if err != nil {
+		return err
+	}
+	c.subscriptions = newSubscriptions(c.ctx, subscription)
+	return nil
+}
+
+// stop ends the subscriptions and health checks
+func (c *pubSubClient) stop() {
+	if c.presence != nil {
+		// remove the clients of this node from the presence registries of the other nodes
+		data, _ := json2.Marshal(c.sequence(presenceUpdate{Type: presenceDown}))
+		_ = c.publish(Payload{Kind: PayloadPresence, Message: data})
+	}
+	c.cancel()
+	if c.pool.getWatcher() == poolWatcher(c) {
+		c.pool.setWatcher(nil)
+	}
+	_ = c.subscriptions.subscription.Close()
+}
+
+func (c *pubSubClient) Ping() error {
+	return c.broker.Health(c.ctx)
+}
+
+// monitor checks the broker health every interval until the client is closed
+func (c *pubSubClient) monitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(c.ctx, interval)
+			err := c.broker.Health(ctx)
+			cancel()
+			if c.ctx.Err() != nil {
+				return
+			}
+			c.setState(err)
+		}
+	}
+}
+
+// onStateChange adds a handler called when the broker state changes
+func (c *pubSubClient) onStateChange(handler BrokerStateHandler) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.stateHandlers = append(c.stateHandlers, handler)
+}
+
+// getState returns the broker state and the error of the last failed health check or publish
+func (c *pubSubClient) getState() (BrokerState, error) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.state, c.stateErr
+}
+
+// setState sets the state to disconnected if err is not nil and to connected otherwise
+// The state handlers are called if the state changed
+func (c *pubSubClient) setState(err error) {
+	state := BrokerConnected
+	if err != nil {
+		state = BrokerDisconnected
+	}
+	c.stateMu.Lock()
+	c.stateErr = err
+	if c.state == state {
+		c.stateMu.Unlock()
+		return
+	}
+	c.state = state
+	handlers := c.stateHandlers
+	c.stateMu.Unlock()
+	if err != nil {
+		log.Println("pub/sub broker disconnected, delivering messages locally only: ", err)
+	} else {
+		log.Println("pub/sub broker connected")
+	}
+	for _, handler := range handlers {
+		handler(state, err)
+	}
+}
+
+// publish delivers the payload to the clients of this node and sends it to the broker for the other nodes
+// If the broker is not reachable, the payload only reaches the clients of this node (degraded mode)
+// and the broker error is returned (after at most Config.BrokerPublishTimeout)
+func (c *pubSubClient) publish(payload Payload) error {
+	payload.Origin = c.nodeID
+	if payload.Node == "" || payload.Node == c.nodeID {
+		delivered := c.deliver(payload)
+		// the message can not reach clients of other nodes
+		if payload.Node == c.nodeID || ((payload.Kind == PayloadClient || payload.Kind == PayloadControl) && delivered > 0) {
+			return nil
+		}
+	}
+	ctx, cancel := c.ctx, context.CancelFunc(func() {})
+	if c.publishTimeout > 0 {
+		ctx, cancel = context.WithTimeout(c.ctx, c.publishTimeout)
+	}
+	err := c.broker.Publish(ctx, c.channels.Of(payload), []byte(payload.toJsonString()))
+	cancel()
+	c.setState(err)
+	return err
+}
+
+// handleIncomingMessages handles one messages from pub/sub and delivers it to the client pool
+func (c *pubSubClient) handleIncomingMessages() MessageHandler {
+	return func(channel string, message []byte) {
+		payload := Payload{}
+		if err := payload.fromJsonString(string(message)); err != nil {
+			log.Println("invalid pub/sub payload on channel " + channel + ": " + err.Error())
+			return
+		}
+		// the publishing node delivered the message already
+		if payload.Origin == c.nodeID {
+			return
+		}
+		if payload.Kind == PayloadPresence {
+			c.receivePresence(payload)
+			return
+		}
+		c.deliver(payload)
+	}
+}
+
+// deliver sends the message of the payload to the recipients connected to this node
+// It returns the number of recipients
+func (c *pubSubClient) deliver(payload Payload) int {
+	recipients := c.pool.recipients(payload)
+	for _, client := range recipients {
+		var err error
+		switch payload.Kind {
+		case PayloadDisconnectUser:
+			err = client.Close()
+		case PayloadControl:
+			err = c.execute(client, payload.Message)
+		default:
+			writeClient(client, payload.Message)
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return len(recipients)
+}
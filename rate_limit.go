@@ -0,0 +1,301 @@
+package groWs
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned by the rate limit middlewares if a limit is exceeded
+var ErrRateLimited = fmt.Errorf("rate limit exceeded: %w", ErrDropMessage)
+
+// ErrorCodeRateLimited is used in error events if a client exceeded a rate limit
+const ErrorCodeRateLimited = "rate_limited"
+
+// RateLimit configures a token bucket
+// Rate tokens are added per second up to Burst tokens, every message or connection takes one token.
+// A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// enabled checks if the limit is configured
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0
+}
+
+// burst returns the bucket size (at least one token)
+func (l RateLimit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// RateLimitAction is what happens to a client that exceeded a limit of the ReceiveMiddleware
+type RateLimitAction int
+
+const (
+	// RateLimitDrop silently drops the message
+	RateLimitDrop RateLimitAction = iota
+	// RateLimitErrorEvent drops the message and sends an error event to the client
+	RateLimitErrorEvent
+	// RateLimitDisconnect drops the message and closes the connection
+	RateLimitDisconnect
+)
+
+// RateLimitStore stores token buckets by key
+type RateLimitStore interface {
+	// Allow takes one token from the bucket of the key and reports if one was available
+	Allow(ctx context.Context, key string, limit RateLimit) (bool, error)
+}
+
+// RateLimitConfig configures the RateLimitMiddleware
+type RateLimitConfig struct {
+	// Store holds the buckets (default: an in-memory store, use App.DefaultRateLimitStore to share limits across nodes)
+	Store RateLimitStore
+	// PerClient limits all messages of a client
+	PerClient RateLimit
+	// PerEvent limits events of a client by event identifier or pattern (e.g. "chat.*")
+	PerEvent map[string]RateLimit
+	// Action taken if PerClient or PerEvent is exceeded
+	Action RateLimitAction
+	// PerIP limits new connections by IP address
+	PerIP RateLimit
+	// IPHeader is used to read the IP address from a header set by a proxy (e.g. "X-Forwarded-For")
+	// Only set it behind a proxy: the header is sent by the client otherwise. Entries added by the client come first,
+	// so the entry added by the outermost trusted proxy is used (see TrustedProxies).
+	IPHeader string
+	// TrustedProxies is the number of proxies in front of the app appending to IPHeader (default 1)
+	// The IP address is the entry TrustedProxies positions from the right, the remote address is used
+	// if the header has fewer entries.
+	TrustedProxies int
+	// PerMeta limits new connections by the value of a client metadata key (e.g. {"UserID": {...}})
+	PerMeta map[string]RateLimit
+}
+
+// RateLimitMiddleware limits messages of clients and new connections using token buckets
+type RateLimitMiddleware struct {
+	config RateLimitConfig
+}
+
+// NewRateLimitMiddleware creates a RateLimitMiddleware
+// If no store is configured, the buckets are kept in memory (see App.DefaultRateLimitStore)
+func NewRateLimitMiddleware(config RateLimitConfig) *RateLimitMiddleware {
+	if config.Store == nil {
+		config.Store = NewMemoryRateLimitStore()
+	}
+	if config.TrustedProxies < 1 {
+		config.TrustedProxies = 1
+	}
+	return &RateLimitMiddleware{config: config}
+}
+
+// HandleReceive returns a ReceiveMiddleware applying the PerClient and PerEvent limits
+func (m *RateLimitMiddleware) HandleReceive() ReceiveMiddleware {
+	return func(client *Client, data []byte) ([]byte, error) {
+		if m.config.PerClient.enabled() && !m.allow("client:"+client.GetID(), m.config.PerClient) {
+			return nil, m.exceeded(client, "")
+		}
+		if len(m.config.PerEvent) == 0 {
+			return data, nil
+		}
+		event, err := client.envelope().Parse(data)
+		if err != nil {
+			return data, nil
+		}
+		pattern, ok := bestEventPattern(m.config.PerEvent, event.Identifier)
+		if !ok || !m.config.PerEvent[pattern].enabled() {
+			return data, nil
+		}
+		if !m.allow("client:"+client.GetID()+":event:"+pattern, m.config.PerEvent[pattern]) {
+			return nil, m.exceeded(client, event.Identifier)
+		}
+		return data, nil
+	}
+}
+
+// HandleHandshake returns a HandshakeMiddleware applying the PerIP and PerMeta limits
+// next is called between both checks (so it can set the metadata used by PerMeta) and may be nil
+func (m *RateLimitMiddleware) HandleHandshake(next HandshakeMiddleware) HandshakeMiddleware {
+	return func(r *http.Request, client *Client) bool {
+		if m.config.PerIP.enabled() && !m.allow("ip:"+m.remoteIP(r), m.config.PerIP) {
+			return false
+		}
+		if next != nil && !next(r, client) {
+			return false
+		}
+		for key, limit := range m.config.PerMeta {
+			value, err := client.GetMeta(key)
+			if err != nil || !limit.enabled() {
+				continue
+			}
+			if !m.allow(fmt.Sprintf("meta:%s:%v", key, value), limit) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// allow takes a token from the store, store errors allow the request
+func (m *RateLimitMiddleware) allow(key string, limit RateLimit) bool {
+	allowed, err := m.config.Store.Allow(context.Background(), key, limit)
+	if err != nil {
+		log.Println("rate limit store error: ", err)
+		return true
+	}
+	return allowed
+}
+
+// exceeded applies the configured action and returns ErrRateLimited
+func (m *RateLimitMiddleware) exceeded(client *Client, event string) error {
+	switch m.config.Action {
+	case RateLimitErrorEvent:
+		_ = client.WriteEvent(NewErrorEvent(ErrorCodeRateLimited, event, "rate limit exceeded", nil))
+	case RateLimitDisconnect:
+		_ = client.Close()
+	}
+	return ErrRateLimited
+}
+
+// remoteIP returns the IP address of the request
+// The entries of IPHeader left of the trusted proxies are set by the client, so they are ignored.
+func (m *RateLimitMiddleware) remoteIP(r *http.Request) string {
+	if m.config.IPHeader != "" {
+		entries := strings.Split(strings.Join(r.Header.Values(m.config.IPHeader), ","), ",")
+		if i := len(entries) - m.config.TrustedProxies; i >= 0 {
+			if ip := strings.TrimSpace(entries[i]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// DefaultRateLimitStore returns a Redis backed store if the app uses a RedisBroker or RedisStreamBroker
+// (so limits hold across nodes) and an in-memory store otherwise
+func (a *App) DefaultRateLimitStore() RateLimitStore {
+	prefix := a.pubsub.channels.Prefix + ":ratelimit:"
+	switch broker := a.pubsub.broker.(type) {
+	case *RedisBroker:
+		return NewRedisRateLimitStore(broker.Client(), prefix)
+	case *RedisStreamBroker:
+		return NewRedisRateLimitStore(broker.Client(), prefix)
+	}
+	return NewMemoryRateLimitStore()
+}
+
+// memoryBucket is a token bucket of the MemoryRateLimitStore
+type memoryBucket struct {
+	tokens float64
+	last   time.Time
+	// expires is the time the bucket is full again (plus a minute) and can be removed
+	expires time.Time
+}
+
+// MemoryRateLimitStore stores token buckets in memory
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+// NewMemoryRateLimitStore creates an in-memory RateLimitStore
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets:   make(map[string]*memoryBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes one token from the bucket of the key
+func (s *MemoryRateLimitStore) Allow(_ context.Context, key string, limit RateLimit) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+	bucket := s.buckets[key]
+	if bucket == nil {
+		bucket = &memoryBucket{tokens: limit.burst(), last: now}
+		s.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(limit.burst(), bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate)
+	bucket.last = now
+	bucket.expires = now.Add(time.Duration(limit.burst()/limit.Rate*float64(time.Second)) + time.Minute)
+	if bucket.tokens < 1 {
+		return false, nil
+	}
+	bucket.tokens--
+	return true, nil
+}
+
+// sweep removes expired buckets once a minute, each bucket expires after its own limit refilled it
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, bucket := range s.buckets {
+		if now.After(bucket.expires) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// redisTokenBucket takes one token from the bucket stored as hash at KEYS[1] using the time of the Redis server
+var redisTokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+tokens = math.min(burst, tokens + (now - ts) * rate / 1000)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+-- format without exponent, tostring writes values like 1e-05 for small fractions and large timestamps
+redis.call('HSET', KEYS[1], 'tokens', string.format('%.9f', tokens), 'ts', string.format('%d', now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return allowed
+`)
+
+// RedisRateLimitStore stores token buckets in Redis so limits hold across nodes
+type RedisRateLimitStore struct {
+	client redis.Scripter
+	prefix string
+}
+
+// NewRedisRateLimitStore creates a RateLimitStore using the Redis client, all keys are prefixed with prefix
+func NewRedisRateLimitStore(client redis.Scripter, prefix string) *RedisRateLimitStore {
+	return &RedisRateLimitStore{client: client, prefix: prefix}
+}
+
+// Allow takes one token from the bucket of the key
+func (s *RedisRateLimitStore) Allow(ctx context.Context, key string, limit RateLimit) (bool, error) {
+	allowed, err := redisTokenBucket.Run(ctx, s.client, []string{s.prefix + key}, limit.Rate, limit.burst()).Int()
+	if err != nil {
+		return false, err
+	}
+	return allowed == 1, nil
+}
@@ -0,0 +1,141 @@
+package groWs
+
+import (
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitStores(t *testing.T) {
+	mr := miniredis.RunT(t)
+	stores := map[string]RateLimitStore{
+		"memory": NewMemoryRateLimitStore(),
+		"redis":  NewRedisRateLimitStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test:"),
+	}
+	limit := RateLimit{Rate: 0.001, Burst: 3}
+	for name, store := range stores {
+		allowed := 0
+		for i := 0; i < 5; i++ {
+			ok, err := store.Allow(context.Background(), "key", limit)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if ok {
+				allowed++
+			}
+		}
+		if allowed != 3 {
+			t.Errorf("%s: expected 3 allowed, got %d", name, allowed)
+		}
+	}
+}
+
+func TestRateLimitMiddlewarePerEvent(t *testing.T) {
+	m := NewRateLimitMiddleware(RateLimitConfig{
+		Store:    NewMemoryRateLimitStore(),
+		PerEvent: map[string]RateLimit{"chat.*": {Rate: 0.001, Burst: 1}},
+	})
+	receive := m.HandleReceive()
+	client := &Client{id: "client"}
+	message := []byte(`{"event":"chat.send","data":"hi"}`)
+	if _, err := receive(client, message); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receive(client, message); !errors.Is(err, ErrRateLimited) || !errors.Is(err, ErrDropMessage) {
+		t.Errorf("expected ErrRateLimited, got %v", err)
+	}
+	if _, err := receive(client, []byte(`{"event":"other"}`)); err != nil {
+		t.Errorf("expected other events to pass, got %v", err)
+	}
+}
+
+func TestRateLimitMiddlewareRemoteIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies int
+		header  []string
+		want    string
+	}{
+		{"without header", 0, nil, "10.0.0.1"},
+		{"spoofed entry is ignored", 0, []string{"1.1.1.1, 2.2.2.2"}, "2.2.2.2"},
+		{"two proxies", 2, []string{"1.1.1.1, 2.2.2.2, 3.3.3.3"}, "2.2.2.2"},
+		{"multiple header lines", 2, []string{"1.1.1.1, 2.2.2.2", "3.3.3.3"}, "2.2.2.2"},
+		{"fewer entries than proxies", 2, []string{"2.2.2.2"}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		m := NewRateLimitMiddleware(RateLimitConfig{IPHeader: "X-Forwarded-For", TrustedProxies: tt.proxies})
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		for _, value := range tt.header {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if got := m.remoteIP(r); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAppDefaultRateLimitStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	redisApp, err := NewApp(Config{Broker: NewRedisBroker(redis.NewClient(&redis.Options{Addr: mr.Addr()}))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer redisApp.pubsub.stop()
+	memoryApp, err := NewApp(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer memoryApp.pubsub.stop()
+	// the store belongs to the app it is created for, not to the app created last
+	if _, ok := redisApp.DefaultRateLimitStore().(*RedisRateLimitStore); !ok {
+		t.Error("expected a Redis store for the app using Redis")
+	}
+	if _, ok := memoryApp.DefaultRateLimitStore().(*MemoryRateLimitStore); !ok {
+		t.Error("expected an in-memory store for the app using a MemoryBroker")
+	}
+}
+
+func TestMemoryRateLimitStoreSweep(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	slow := RateLimit{Rate: 0.001, Burst: 1}
+	if ok, _ := store.Allow(context.Background(), "slow", slow); !ok {
+		t.Fatal("expected first message to be allowed")
+	}
+	// a sweep triggered by a fast limit must not reset the bucket of the slow limit
+	store.buckets["slow"].last = time.Now().Add(-2 * time.Minute)
+	store.lastSweep = time.Now().Add(-2 * time.Minute)
+	if ok, _ := store.Allow(context.Background(), "fast", RateLimit{Rate: 100, Burst: 1}); !ok {
+		t.Fatal("expected fast message to be allowed")
+	}
+	if store.buckets["slow"] == nil {
+		t.Fatal("expected slow bucket to be kept")
+	}
+	store.buckets["slow"].expires = time.Now().Add(-time.Second)
+	store.lastSweep = time.Now().Add(-2 * time.Minute)
+	_, _ = store.Allow(context.Background(), "fast", RateLimit{Rate: 100, Burst: 1})
+	if store.buckets["slow"] != nil {
+		t.Error("expected expired slow bucket to be removed")
+	}
+}
+
+func TestRedisRateLimitStoreFractionalTokens(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store := NewRedisRateLimitStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test:")
+	limit := RateLimit{Rate: 0.001, Burst: 1}
+	for i := 0; i < 3; i++ {
+		if _, err := store.Allow(context.Background(), "key", limit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, field := range []string{"tokens", "ts"} {
+		if value := mr.HGet("test:key", field); strings.ContainsAny(value, "eE") {
+			t.Errorf("expected %s without exponent, got %q", field, value)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package groWs
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedisBroker is a Broker using Redis Pub/Sub
+type RedisBroker struct {
+	client redis.UniversalClient
+	mu     sync.Mutex
+	subs   []*redis.PubSub
+	closed bool
+}
+
+// NewRedisBroker creates a Broker using the Redis client
+func NewRedisBroker(client redis.UniversalClient) *RedisBroker {
+	return &RedisBroker{client: client}
+}
+
+// newRedisBrokerFromConfig connects to the Redis server(s) configured in the config
+// It returns an error if the server can not be reached
+func newRedisBrokerFromConfig(ctx context.Context, config Config) (*RedisBroker, error) {
+	client, err := connectRedis(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewRedisBroker(client), nil
+}
+
+// connectRedis returns the Redis client of the config and checks the connection
+func connectRedis(ctx context.Context, config Config) (redis.UniversalClient, error) {
+	client := config.RedisClient
+	if client == nil {
+		client = newRedisClient(redisOptions(config), len(config.RedisClusterAddrs) > 0)
+	}
+	// ping redis
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("redis connection failed: %w", err)
+	}
+	return client, nil
+}
+
+// redisOptions builds the Redis options of the config
+func redisOptions(config Config) *redis.UniversalOptions {
+	if config.RedisOptions != nil {
+		return config.RedisOptions
+	}
+	options := &redis.UniversalOptions{
+		Username:   config.RedisUsername,
+		Password:   config.RedisPassword,
+		DB:         config.RedisDB,
+		MasterName: config.RedisSentinelMaster,
+		TLSConfig:  config.RedisTLSConfig,
+	}
+	if options.TLSConfig == nil && config.RedisTLS {
+		options.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: config.RedisHost}
+	}
+	switch {
+	case len(config.RedisClusterAddrs) > 0:
+		options.Addrs = config.RedisClusterAddrs
+	case config.RedisSentinelMaster != "":
+		options.Addrs = config.RedisSentinelAddrs
+	default:
+		port := config.RedisPort
+		if port == 0 {
+			port = 6379
+		}
+		options.Addrs = []string{config.RedisHost + ":" + strconv.Itoa(port)}
+	}
+	return options
+}
+
+// newRedisClient creates a failover client if a sentinel master is set, a cluster client in cluster mode
+// or for multiple addresses and a single node client otherwise
+func newRedisClient(options *redis.UniversalOptions, cluster bool) redis.UniversalClient {
+	switch {
+	case options.MasterName != "":
+		return redis.NewFailoverClient(options.Failover())
+	case cluster || len(options.Addrs) > 1:
+		return redis.NewClusterClient(options.Cluster())
+	default:
+		return redis.NewClient(options.Simple())
+	}
+}
+
+// Client returns the underlying Redis client
+func (b *RedisBroker) Client() redis.UniversalClient {
+	return b.client
+}
+
+// Publish publishes the payload to the channel
+func (b *RedisBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	return b.client.Publish(ctx, channel, payload).Err()
+}
+
+// Subscribe subscribes to the channels and calls the handler for each incoming message
+// The handler is called on one goroutine per subscription, so messages are handled in the order they are received.
+func (b *RedisBroker) Subscribe(ctx context.Context, handler MessageHandler, channels ...string) (Subscription, error) {
+	exact, patterns := splitPatterns(channels)
+	subs := b.client.Subscribe(ctx, exact...)
+	if len(patterns) > 0 {
+		if err := subs.PSubscribe(ctx, patterns...); err != nil {
+			_ = subs.Close()
+			return nil, err
+		}
+	}
+	// wait for the subscriptions to be confirmed, messages received meanwhile are handled first
+	pending := make([]*redis.Message, 0)
+	for confirmed := 0; confirmed < len(channels); {
+		received, err := subs.Receive(ctx)
+		if err != nil {
+			_ = subs.Close()
+			return nil, err
+		}
+		switch msg := received.(type) {
+		case *redis.Subscription:
+			confirmed++
+		case *redis.Message:
+			pending = append(pending, msg)
+		}
+	}
+	b.mu.Lock()
+	b.subs = append(b.subs, subs)
+	b.mu.Unlock()
+	go b.receive(ctx, subs, handler, pending)
+	return &redisSubscription{broker: b, subs: subs}, nil
+}
+
+// splitPatterns splits channels into exact channels and patterns (subscribed with PSUBSCRIBE)
+func splitPatterns(channels []string) ([]string, []string) {
+	exact := make([]string, 0, len(channels))
+	patterns := make([]string, 0)
+	for _, channel := range channels {
+		if strings.HasSuffix(channel, "*") {
+			patterns = append(patterns, channel)
+		} else {
+			exact = append(exact, channel)
+		}
+	}
+	return exact, patterns
+}
+
+// redisSubscription is a Redis Pub/Sub connection of a RedisBroker
+type redisSubscription struct {
+	broker *RedisBroker
+	subs   *redis.PubSub
+}
+
+// Subscribe adds channels to the subscription
+func (s *redisSubscription) Subscribe(ctx context.Context, channels ...string) error {
+	exact, patterns := splitPatterns(channels)
+	if len(exact) > 0 {
+		if err := s.subs.Subscribe(ctx, exact...); err != nil {
+			return err
+		}
+	}
+	if len(patterns) > 0 {
+		return s.subs.PSubscribe(ctx, patterns...)
+	}
+	return nil
+}
+
+// Unsubscribe removes channels from the subscription
+func (s *redisSubscription) Unsubscribe(ctx context.Context, channels ...string) error {
+	exact, patterns := splitPatterns(channels)
+	if len(exact) > 0 {
+		if err := s.subs.Unsubscribe(ctx, exact...); err != nil {
+			return err
+		}
+	}
+	if len(patterns) > 0 {
+		return s.subs.PUnsubscribe(ctx, patterns...)
+	}
+	return nil
+}
+
+// Close closes the Pub/Sub connection
+func (s *redisSubscription) Close() error {
+	s.broker.mu.Lock()
+	for i, subs := range s.broker.subs {
+		if subs == s.subs {
+			s.broker.subs = append(s.broker.subs[:i], s.broker.subs[i+1:]...)
+			break
+		}
+	}
+	s.broker.mu.Unlock()
+	return s.subs.Close()
+}
+
+// receive calls the handler for the pending and each incoming message in order until the subscription is closed
+// On errors it waits with exponential backoff, go-redis reconnects and resubscribes on the next receive
+func (b *RedisBroker) receive(ctx context.Context, subs *redis.PubSub, handler MessageHandler, pending []*redis.Message) {
+	for _, msg := range pending {
+		handler(msg.Channel, []byte(msg.Payload))
+	}
+	var backoff time.Duration
+	for {
+		msg, err := subs.ReceiveMessage(ctx)
+		if err == nil {
+			backoff = 0
+			handler(msg.Channel, []byte(msg.Payload))
+			continue
+		}
+		if errors.Is(err, redis.ErrClosed) || b.isClosed() || ctx.Err() != nil {
+			return
+		}
+		backoff = nextBackoff(backoff)
+		log.Printf("redis subscription error, reconnecting in %s: %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Health pings the Redis server
+func (b *RedisBroker) Health(ctx context.Context) error {
+	return b.client.Ping(ctx).Err()
+}
+
+// isClosed checks if Close was called
+func (b *RedisBroker) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+// Close closes the subscriptions and the Redis client
+func (b *RedisBroker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	subs := b.subs
+	b.subs = nil
+	b.mu.Unlock()
+	for _, s := range subs {
+		_ = s.Close()
+	}
+	return b.client.Close()
+}
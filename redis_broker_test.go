@@ -0,0 +1,246 @@
+package groWs
+
+import (
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRedisBroker(t *testing.T) {
+	mr := miniredis.RunT(t)
+	broker := NewRedisBroker(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	defer broker.Close()
+	received := make(chan string, 2)
+	_, err := broker.Subscribe(context.Background(), func(channel string, payload []byte) {
+		received <- channel + "=" + string(payload)
+	}, "a", "p:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = broker.Publish(context.Background(), "a", []byte("1"))
+	_ = broker.Publish(context.Background(), "p:x", []byte("2"))
+	messages := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case message := <-received:
+			messages[message] = true
+		case <-time.After(time.Second):
+			t.Fatalf("timeout, received %v", messages)
+		}
+	}
+	if !messages["a=1"] || !messages["p:x=2"] {
+		t.Fatalf("unexpected messages: %v", messages)
+	}
+}
+
+func TestRedisBrokerOrderedDelivery(t *testing.T) {
+	mr := miniredis.RunT(t)
+	broker := NewRedisBroker(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	defer broker.Close()
+	publisher := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer publisher.Close()
+	// publish while the channels are subscribed, messages received before all confirmations must not be lost
+	stop := make(chan struct{})
+	published := make(chan int)
+	go func() {
+		i := 0
+		for ; ; i++ {
+			select {
+			case <-stop:
+				published <- i
+				return
+			default:
+			}
+			_ = publisher.Publish(context.Background(), "c0", strconv.Itoa(i)).Err()
+		}
+	}()
+	received := make(chan int, 100000)
+	channels := make([]string, 200)
+	for i := range channels {
+		channels[i] = "c" + strconv.Itoa(i)
+	}
+	if _, err := broker.Subscribe(context.Background(), func(channel string, payload []byte) {
+		i, _ := strconv.Atoi(string(payload))
+		received <- i
+	}, channels...); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	last := <-published - 1
+	next := -1
+	for next != last {
+		select {
+		case i := <-received:
+			if next != -1 && i != next+1 {
+				t.Fatalf("expected message %d, got %d", next+1, i)
+			}
+			next = i
+		case <-time.After(time.Second):
+			t.Fatalf("timeout after message %d of %d", next, last)
+		}
+	}
+}
+
+func TestRedisOptions(t *testing.T) {
+	options := redisOptions(Config{RedisHost: "redis", RedisPassword: "secret", RedisDB: 2, RedisTLS: true})
+	if len(options.Addrs) != 1 || options.Addrs[0] != "redis:6379" || options.Password != "secret" || options.DB != 2 {
+		t.Fatalf("unexpected options: %+v", options)
+	}
+	if options.TLSConfig == nil || options.TLSConfig.ServerName != "redis" {
+		t.Fatal("expected TLS config")
+	}
+	options = redisOptions(Config{RedisSentinelMaster: "mymaster", RedisSentinelAddrs: []string{"s1:26379", "s2:26379"}})
+	if _, ok := newRedisClient(options, false).(*redis.Client); !ok || options.MasterName != "mymaster" || len(options.Addrs) != 2 {
+		t.Fatalf("expected failover client, options: %+v", options)
+	}
+	options = redisOptions(Config{RedisClusterAddrs: []string{"c1:7000"}})
+	if _, ok := newRedisClient(options, true).(*redis.ClusterClient); !ok {
+		t.Fatal("expected cluster client")
+	}
+}
+
+func TestNewAppRedisConnectionError(t *testing.T) {
+	mr := miniredis.RunT(t)
+	addr := mr.Addr()
+	mr.Close()
+	_, err := NewApp(Config{EnablePubSub: true, RedisOptions: &redis.UniversalOptions{Addrs: []string{addr}, MaxRetries: -1}})
+	if err == nil {
+		t.Fatal("expected connection error")
+	}
+}
+
+func TestRedisStreamBroker(t *testing.T) {
+	mr := miniredis.RunT(t)
+	newBroker := func() *RedisStreamBroker {
+		broker, err := NewRedisStreamBroker(redis.NewClient(&redis.Options{Addr: mr.Addr()}),
+			RedisStreamOptions{Group: "node-1", MaxLen: 100, Block: 10 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return broker
+	}
+	broker := newBroker()
+	received := make(chan string, 10)
+	handler := func(channel string, payload []byte) {
+		received <- channel + "=" + string(payload)
+	}
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case message := <-received:
+			if message != want {
+				t.Fatalf("received %q, want %q", message, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+	subscription, err := broker.Subscribe(context.Background(), handler, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = broker.Publish(context.Background(), "a", []byte("1"))
+	expect("a=1")
+	if err := subscription.Subscribe(context.Background(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	_ = broker.Publish(context.Background(), "b", []byte("2"))
+	expect("b=2")
+	if _, err := broker.Subscribe(context.Background(), handler, "p:*"); err != ErrStreamPattern {
+		t.Fatalf("expected ErrStreamPattern, got %v", err)
+	}
+
+	// messages published while the node is down are replayed after the restart
+	_ = broker.Close()
+	publisher := NewRedisBroker(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	defer publisher.Close()
+	_ = publisher.Client().XAdd(context.Background(), &redis.XAddArgs{Stream: "a", Values: []interface{}{"payload", "3"}}).Err()
+	_ = publisher.Client().XAdd(context.Background(), &redis.XAddArgs{Stream: "b", Values: []interface{}{"payload", "skipped"}}).Err()
+	broker = newBroker()
+	defer broker.Close()
+	subscription, err = broker.Subscribe(context.Background(), handler, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("a=3")
+
+	// streams added to a subscription are not replayed (e.g. rooms joined after the restart)
+	if err := subscription.Subscribe(context.Background(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	_ = broker.Publish(context.Background(), "b", []byte("6"))
+	expect("b=6")
+	_ = subscription.Unsubscribe(context.Background(), "b")
+
+	// streams subscribed again skip the messages published while unsubscribed
+	_ = subscription.Unsubscribe(context.Background(), "a")
+	_ = broker.Publish(context.Background(), "a", []byte("4"))
+	_ = subscription.Subscribe(context.Background(), "a")
+	_ = broker.Publish(context.Background(), "a", []byte("5"))
+	expect("a=5")
+}
+
+func TestRedisStreamBrokerRetention(t *testing.T) {
+	mr := miniredis.RunT(t)
+	broker, err := NewRedisStreamBroker(redis.NewClient(&redis.Options{Addr: mr.Addr()}),
+		RedisStreamOptions{Group: "node-1", Block: 10 * time.Millisecond, TTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	subscription, err := broker.Subscribe(context.Background(), func(string, []byte) {}, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := subscription.Subscribe(context.Background(), "room"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL("room"); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("expected the stream to expire, ttl %s", ttl)
+	}
+
+	// the consumer group is deleted when the stream is unsubscribed
+	if err := subscription.Unsubscribe(context.Background(), "room"); err != nil {
+		t.Fatal(err)
+	}
+	groups, err := broker.Client().XInfoGroups(context.Background(), "room").Result()
+	if err != nil || len(groups) != 0 {
+		t.Fatalf("expected no consumer groups, got %v (%v)", groups, err)
+	}
+
+	// publishing renews the ttl, idle streams expire
+	mr.FastForward(30 * time.Second)
+	if err := broker.Publish(context.Background(), "room", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL("room"); ttl != time.Minute {
+		t.Fatalf("expected the ttl to be renewed, got %s", ttl)
+	}
+	mr.FastForward(2 * time.Minute)
+	if mr.Exists("room") {
+		t.Fatal("expected the idle stream to expire")
+	}
+	// a stream that expired while subscribed can be unsubscribed
+	if err := subscription.Subscribe(context.Background(), "room"); err != nil {
+		t.Fatal(err)
+	}
+	mr.FastForward(2 * time.Minute)
+	if err := subscription.Unsubscribe(context.Background(), "room"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewAppRedisStreamsConfig(t *testing.T) {
+	if _, err := NewApp(Config{EnablePubSub: true, RedisStreams: true}); !errors.Is(err, ErrStreamNodeID) {
+		t.Errorf("expected ErrStreamNodeID, got %v", err)
+	}
+	config := Config{EnablePubSub: true, RedisStreams: true, NodeID: "node-1", RedisClusterAddrs: []string{"localhost:7000"}}
+	if _, err := NewApp(config); !errors.Is(err, ErrStreamCluster) {
+		t.Errorf("expected ErrStreamCluster, got %v", err)
+	}
+}
@@ -0,0 +1,413 @@
+package groWs
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrStreamGroupRequired is returned if a RedisStreamBroker is created without consumer group
+	ErrStreamGroupRequired = errors.New("redis streams: consumer group required")
+	// ErrStreamPattern is returned if a pattern is subscribed using a RedisStreamBroker
+	ErrStreamPattern = errors.New("redis streams: patterns are not supported")
+	// ErrStreamNodeID is returned by NewApp if RedisStreams is used without Config.NodeID
+	ErrStreamNodeID = errors.New("redis streams: a stable Config.NodeID is required")
+	// ErrStreamCluster is returned by NewApp if RedisStreams is used with Redis Cluster
+	ErrStreamCluster = errors.New("redis streams: redis cluster is not supported")
+)
+
+const (
+	// DefaultStreamMaxLen is the default number of messages retained per stream
+	DefaultStreamMaxLen = 10000
+	// DefaultStreamBlock is the default time a read waits for new messages
+	DefaultStreamBlock = time.Second
+	// DefaultStreamTTL is the default time a stream is kept without new messages
+	DefaultStreamTTL = 24 * time.Hour
+	// streamField is the field of the stream entries holding the payload
+	streamField = "payload"
+)
+
+// RedisStreamOptions configures a RedisStreamBroker
+type RedisStreamOptions struct {
+	// Group is the consumer group of the node, it has to be unique per node and stable across restarts
+	// to replay the messages published while the node was down (e.g. Config.NodeID)
+	Group string
+	// MaxLen is the approximate number of messages retained per stream (default: DefaultStreamMaxLen)
+	MaxLen int64
+	// TTL is the time a stream (with its consumer groups) is kept without new messages (default: DefaultStreamTTL,
+	// negative keeps the streams forever). Messages published to a node that is down for longer are not replayed.
+	TTL time.Duration
+	// Block is the time a read waits for new messages, newly subscribed streams are read after it (default: DefaultStreamBlock)
+	Block time.Duration
+	// Count is the maximum number of messages read at once (default: 100)
+	Count int64
+}
+
+// RedisStreamBroker is a Broker using Redis Streams
+// Every channel is a stream (trimmed to MaxLen messages) read by one consumer group per node,
+// so messages published while a node is restarting are delivered when it subscribes again.
+// Retention: a stream expires TTL after its last message (removing the consumer groups of all nodes) and the
+// consumer group of a node is deleted when the node unsubscribes the stream (e.g. the last local client left the room),
+// so the streams and groups of idle rooms, tenants and clients do not accumulate.
+// Only the channels passed to Subscribe are replayed, channels added to a subscription later (e.g. rooms and tenants,
+// subscribed when the first local client needs them) start with new messages.
+// Patterns are not supported and all streams are read with one command, so Redis Cluster is not supported.
+type RedisStreamBroker struct {
+	client  redis.UniversalClient
+	options RedisStreamOptions
+
+	mu            sync.RWMutex
+	subscriptions []*redisStreamSubscription
+	// groups are the streams the consumer group was created for
+	groups map[string]bool
+	cancel context.CancelFunc
+	done   chan struct{}
+	closed bool
+}
+
+// NewRedisStreamBroker creates a Broker using Redis Streams
+func NewRedisStreamBroker(client redis.UniversalClient, options RedisStreamOptions) (*RedisStreamBroker, error) {
+	if options.Group == "" {
+		return nil, ErrStreamGroupRequired
+	}
+	if options.MaxLen <= 0 {
+		options.MaxLen = DefaultStreamMaxLen
+	}
+	if options.Block <= 0 {
+		options.Block = DefaultStreamBlock
+	}
+	if options.Count <= 0 {
+		options.Count = 100
+	}
+	if options.TTL == 0 {
+		options.TTL = DefaultStreamTTL
+	}
+	return &RedisStreamBroker{
+		client:  client,
+		options: options,
+		groups:  make(map[string]bool),
+	}, nil
+}
+
+// newRedisStreamBrokerFromConfig connects to the Redis server configured in the config
+// The node ID is used as consumer group, so it has to be set explicitly
+func newRedisStreamBrokerFromConfig(ctx context.Context, config Config) (*RedisStreamBroker, error) {
+	if config.NodeID == "" {
+		return nil, ErrStreamNodeID
+	}
+	if _, ok := config.RedisClient.(*redis.ClusterClient); ok || len(config.RedisClusterAddrs) > 0 {
+		return nil, ErrStreamCluster
+	}
+	client, err := connectRedis(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewRedisStreamBroker(client, RedisStreamOptions{Group: config.NodeID, MaxLen: config.RedisStreamMaxLen,
+		TTL: config.RedisStreamTTL})
+}
+
+// Client returns the underlying Redis client
+func (b *RedisStreamBroker) Client() redis.UniversalClient {
+	return b.client
+}
+
+// Publish adds the payload to the stream of the channel, trims it to about MaxLen messages and renews its TTL
+func (b *RedisStreamBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	_, err := b.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: channel,
+			MaxLen: b.options.MaxLen,
+			Approx: true,
+			Values: []interface{}{streamField, payload},
+		})
+		if b.options.TTL > 0 {
+			pipe.PExpire(ctx, channel, b.options.TTL)
+		}
+		return nil
+	})
+	return err
+}
+
+// Subscribe creates the consumer group of the streams and calls the handler for their messages
+// The first call starts reading the streams, beginning with the messages not acknowledged before a restart.
+func (b *RedisStreamBroker) Subscribe(ctx context.Context, handler MessageHandler, channels ...string) (Subscription, error) {
+	s := &redisStreamSubscription{broker: b, handler: handler, channels: make(map[string]bool, len(channels))}
+	if err := s.subscribe(ctx, true, channels...); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+	b.subscriptions = append(b.subscriptions, s)
+	if b.cancel == nil {
+		readCtx, cancel := context.WithCancel(context.Background())
+		b.cancel, b.done = cancel, make(chan struct{})
+		go b.read(readCtx)
+	}
+	return s, nil
+}
+
+// createGroups creates the consumer group of the streams starting at new messages
+// Streams subscribed again after being unsubscribed skip the messages published meanwhile (the group was deleted).
+// With replay, an existing group of a previous run keeps its position, so the messages published
+// while the node was down are replayed; otherwise the group is reset to the end of the stream.
+func (b *RedisStreamBroker) createGroups(ctx context.Context, streams []string, replay bool) error {
+	for _, stream := range streams {
+		if strings.HasSuffix(stream, "*") {
+			return ErrStreamPattern
+		}
+		b.mu.RLock()
+		created := b.groups[stream]
+		b.mu.RUnlock()
+		if created {
+			continue
+		}
+		err := b.client.XGroupCreateMkStream(ctx, stream, b.options.Group, "$").Err()
+		if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") && !replay {
+			// the group of a previous run, recreate it at the end of the stream
+			if err = b.client.XGroupDestroy(ctx, stream, b.options.Group).Err(); err == nil {
+				err = b.client.XGroupCreateMkStream(ctx, stream, b.options.Group, "$").Err()
+			}
+		}
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return err
+		}
+		if b.options.TTL > 0 {
+			// a stream created by the group without messages expires as well
+			if err := b.client.PExpire(ctx, stream, b.options.TTL).Err(); err != nil {
+				return err
+			}
+		}
+		b.mu.Lock()
+		b.groups[stream] = true
+		b.mu.Unlock()
+	}
+	return nil
+}
+
+// subscribed checks if a subscription contains the stream (b.mu has to be held)
+func (b *RedisStreamBroker) subscribed(stream string) bool {
+	for _, s := range b.subscriptions {
+		if s.channels[stream] {
+			return true
+		}
+	}
+	return false
+}
+
+// destroyGroups deletes the consumer group of the streams
+func (b *RedisStreamBroker) destroyGroups(ctx context.Context, streams []string) error {
+	for _, stream := range streams {
+		// an expired stream has no group left
+		if err := b.client.XGroupDestroy(ctx, stream, b.options.Group).Err(); err != nil && !isNoStream(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// isNoStream checks if the error reports a stream that does not exist
+func isNoStream(err error) bool {
+	return strings.Contains(err.Error(), "requires the key to exist") || strings.HasPrefix(err.Error(), "NOGROUP")
+}
+
+// streams returns the streams of all subscriptions
+func (b *RedisStreamBroker) streams() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	set := make(map[string]bool)
+	for _, s := range b.subscriptions {
+		for channel := range s.channels {
+			set[channel] = true
+		}
+	}
+	streams := make([]string, 0, len(set))
+	for stream := range set {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+	return streams
+}
+
+// handlers returns the handlers of the subscriptions of the stream
+func (b *RedisStreamBroker) handlers(stream string) []MessageHandler {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	handlers := make([]MessageHandler, 0, len(b.subscriptions))
+	for _, s := range b.subscriptions {
+		if s.channels[stream] {
+			handlers = append(handlers, s.handler)
+		}
+	}
+	return handlers
+}
+
+// read reads the subscribed streams until the context is canceled
+// It starts with the pending messages of the consumer (delivered but not acknowledged before a restart),
+// acknowledges every message after calling the handlers and waits with exponential backoff on errors.
+func (b *RedisStreamBroker) read(ctx context.Context) {
+	defer close(b.done)
+	pending := true
+	var backoff time.Duration
+	for ctx.Err() == nil {
+		streams := b.streams()
+		if len(streams) == 0 {
+			select {
+			case <-time.After(b.options.Block):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		id := ">"
+		if pending {
+			id = "0"
+		}
+		args := append([]string(nil), streams...)
+		for range streams {
+			args = append(args, id)
+		}
+		result, err := b.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    b.options.Group,
+			Consumer: b.options.Group,
+			Streams:  args,
+			Count:    b.options.Count,
+			Block:    b.options.Block,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			pending = false
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, redis.ErrClosed) {
+				return
+			}
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				// the stream was deleted, recreate the groups
+				b.mu.Lock()
+				b.groups = make(map[string]bool)
+				b.mu.Unlock()
+				// (of the streams still subscribed, an unsubscribed stream may have been deleted meanwhile)
+				if err := b.createGroups(ctx, b.streams(), true); err == nil {
+					continue
+				}
+			}
+			backoff = nextBackoff(backoff)
+			log.Printf("redis streams read error, retrying in %s: %v", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		backoff = 0
+		read := 0
+		for _, stream := range result {
+			for _, message := range stream.Messages {
+				read++
+				b.deliver(stream.Stream, message)
+				if err := b.client.XAck(ctx, stream.Stream, b.options.Group, message.ID).Err(); err != nil {
+					log.Println("redis streams ack error: ", err)
+				}
+			}
+		}
+		if pending && read == 0 {
+			pending = false
+		}
+	}
+}
+
+// deliver calls the handlers of the stream with the payload of the message
+func (b *RedisStreamBroker) deliver(stream string, message redis.XMessage) {
+	payload, ok := message.Values[streamField].(string)
+	if !ok {
+		log.Println("redis streams: message " + message.ID + " of " + stream + " has no payload")
+		return
+	}
+	for _, handler := range b.handlers(stream) {
+		handler(stream, []byte(payload))
+	}
+}
+
+// Health pings the Redis server
+func (b *RedisStreamBroker) Health(ctx context.Context) error {
+	return b.client.Ping(ctx).Err()
+}
+
+// Close stops reading the streams and closes the Redis client
+// The consumer group is kept, so the node continues with the next message after a restart.
+func (b *RedisStreamBroker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.subscriptions = nil
+	cancel, done := b.cancel, b.done
+	b.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	return b.client.Close()
+}
+
+// redisStreamSubscription is a set of streams read by a RedisStreamBroker
+type redisStreamSubscription struct {
+	broker  *RedisStreamBroker
+	handler MessageHandler
+	// channels are guarded by broker.mu
+	channels map[string]bool
+}
+
+// Subscribe creates the consumer group of the streams and adds them to the subscription
+// The streams start with new messages, messages published before (e.g. while the node was down) are not replayed.
+func (s *redisStreamSubscription) Subscribe(ctx context.Context, channels ...string) error {
+	return s.subscribe(ctx, false, channels...)
+}
+
+// subscribe creates the consumer group of the streams (see createGroups) and adds them to the subscription
+func (s *redisStreamSubscription) subscribe(ctx context.Context, replay bool, channels ...string) error {
+	if err := s.broker.createGroups(ctx, channels, replay); err != nil {
+		return err
+	}
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	for _, channel := range channels {
+		s.channels[channel] = true
+	}
+	return nil
+}
+
+// Unsubscribe removes streams from the subscription
+// The consumer group of a stream no other subscription contains is deleted.
+func (s *redisStreamSubscription) Unsubscribe(ctx context.Context, channels ...string) error {
+	s.broker.mu.Lock()
+	unused := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		delete(s.channels, channel)
+		if !s.broker.subscribed(channel) && s.broker.groups[channel] {
+			delete(s.broker.groups, channel)
+			unused = append(unused, channel)
+		}
+	}
+	s.broker.mu.Unlock()
+	return s.broker.destroyGroups(ctx, unused)
+}
+
+// Close removes the subscription
+func (s *redisStreamSubscription) Close() error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	for i, subscription := range s.broker.subscriptions {
+		if subscription == s {
+			s.broker.subscriptions = append(s.broker.subscriptions[:i], s.broker.subscriptions[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package groWs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// SessionEventIdentifier is the identifier of the event sent to a client after (re)connecting
+	// with the session token to use for resuming the session
+	SessionEventIdentifier = "session"
+	// DefaultSessionTokenParam is the query param used to send the session token on reconnect
+	DefaultSessionTokenParam = "session_token"
+	// SessionTokenHeader is the header that can be used instead of the query param
+	SessionTokenHeader = "X-Session-Token"
+	// DefaultSessionBufferSize is the default number of messages buffered for a disconnected client
+	DefaultSessionBufferSize = 100
+)
+
+// SessionData is the data of the session event
+type SessionData struct {
+	// ID of the client (stays the same after resuming)
+	ID string `json:"id"`
+	// Token to send on reconnect to resume the session (a new token is issued on every connect)
+	Token string `json:"token"`
+	// Resumed is true if the session was resumed
+	Resumed bool `json:"resumed"`
+	// GracePeriod in seconds a disconnected session can be resumed
+	GracePeriod float64 `json:"grace_period"`
+}
+
+// session is a resumable session of a client
+type session struct {
+	token    string
+	client   *Client
+	route    string
+	timer    *time.Timer
+	finalize func()
+}
+
+// sessionStore holds the resumable sessions by token and client
+type sessionStore struct {
+	mu         sync.Mutex
+	grace      time.Duration
+	bufferSize int
+	tokenParam string
+	byToken    map[string]*session
+	byClient   map[*Client]*session
+}
+
+// newSessionStore creates the store of resumable sessions of an app (nil if no grace period is configured)
+func newSessionStore(config Config) *sessionStore {
+	if config.SessionGracePeriod <= 0 {
+		return nil
+	}
+	if config.SessionBufferSize == 0 {
+		config.SessionBufferSize = DefaultSessionBufferSize
+	}
+	if config.SessionTokenParam == "" {
+		config.SessionTokenParam = DefaultSessionTokenParam
+	}
+	return &sessionStore{
+		grace:      config.SessionGracePeriod,
+		bufferSize: config.SessionBufferSize,
+		tokenParam: config.SessionTokenParam,
+		byToken:    make(map[string]*session),
+		byClient:   make(map[*Client]*session),
+	}
+}
+
+// tokenFromRequest reads the session token from the query param or header
+func (s *sessionStore) tokenFromRequest(r *http.Request) string {
+	if token := r.URL.Query().Get(s.tokenParam); token != "" {
+		return token
+	}
+	return r.Header.Get(SessionTokenHeader)
+}
+
+// issue creates a new token for the client (replacing the previous one) and returns it
+// finalize is called when the session ends (grace period expired or closed by the server)
+func (s *sessionStore) issue(client *Client, finalize func()) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old := s.byClient[client]; old != nil {
+		delete(s.byToken, old.token)
+	}
+	client.connMu.Lock()
+	client.bufferSize = s.bufferSize
+	client.connMu.Unlock()
+	sess := &session{token: token, client: client, route: client.route, finalize: finalize}
+	s.byToken[token] = sess
+	s.byClient[client] = sess
+	return token, nil
+}
+
+// claim returns the client of the session if it can be resumed on the route
+// The grace timer of a disconnected session is stopped, call release if resuming fails
+func (s *sessionStore) claim(token string, route string) *Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := s.byToken[token]
+	if sess == nil || sess.route != route {
+		return nil
+	}
+	if sess.timer != nil {
+		if !sess.timer.Stop() {
+			// grace period expired, the session is being finalized
+			return nil
+		}
+		sess.timer = nil
+	}
+	return sess.client
+}
+
+// release restarts the grace period of a claimed session if the client is still disconnected
+func (s *sessionStore) release(client *Client) {
+	if client.getConn() == nil {
+		s.suspend(client)
+	}
+}
+
+// suspend starts the grace period of the session of a disconnected client
+// It returns false if the client has no session or was closed by the server
+func (s *sessionStore) suspend(client *Client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := s.byClient[client]
+	if sess == nil || client.isClosed() {
+		return false
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(s.grace, func() {
+		s.mu.Lock()
+		if sess.timer != timer {
+			s.mu.Unlock()
+			return
+		}
+		s.removeLocked(sess)
+		s.mu.Unlock()
+		sess.finalize()
+	})
+	sess.timer = timer
+	return true
+}
+
+// expire ends the session of a disconnected client immediately
+func (s *sessionStore) expire(client *Client) {
+	s.mu.Lock()
+	sess := s.byClient[client]
+	if sess == nil || sess.timer == nil || !sess.timer.Stop() {
+		s.mu.Unlock()
+		return
+	}
+	s.removeLocked(sess)
+	s.mu.Unlock()
+	sess.finalize()
+}
+
+// remove deletes the session of the client
+func (s *sessionStore) remove(client *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess := s.byClient[client]; sess != nil {
+		s.removeLocked(sess)
+	}
+}
+
+// removeLocked deletes the session (mu must be held)
+func (s *sessionStore) removeLocked(sess *session) {
+	delete(s.byToken, sess.token)
+	delete(s.byClient, sess.client)
+}
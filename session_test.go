@@ -0,0 +1,121 @@
+package groWs
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bufferedConn reads the data buffered during the handshake first
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// dialTestServer connects to a websocket test server
+func dialTestServer(t *testing.T, url string) net.Conn {
+	t.Helper()
+	conn, br, _, err := ws.Dial(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br == nil {
+		return conn
+	}
+	return bufferedConn{Conn: conn, reader: io.MultiReader(br, conn)}
+}
+
+// readTestEvent reads the next event sent by the server
+func readTestEvent(t *testing.T, conn net.Conn) Event {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := wsutil.ReadServerText(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := FromJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestSessionResumption(t *testing.T) {
+
+	disconnected := make(chan string, 1)
+	handler := NewClientHandler()
+	handler.OnConnect(func(client *Client) error {
+		client.SetMeta("name", "resumable")
+		return AddClientToRoom(client, "session-room")
+	})
+	handler.OnDisconnect(func(client *Client) error {
+		disconnected <- client.GetID()
+		return nil
+	})
+	app, err := NewApp(Config{SessionGracePeriod: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(app.buildHandlerFunc("/", handler)))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	conn := dialTestServer(t, url)
+	var session SessionData
+	raw, _ := json.Marshal(readTestEvent(t, conn).Data)
+	_ = json.Unmarshal(raw, &session)
+	if session.Token == "" || session.Resumed {
+		t.Fatalf("unexpected session %+v", session)
+	}
+	_ = conn.Close()
+
+	// wait until the server noticed the disconnect, then broadcast to the buffered client
+	deadline := time.Now().Add(2 * time.Second)
+	for GetClient(session.ID).getConn() != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	GetClientPool().SendToRoom("session-room", []byte(`{"event":"missed","data":1}`))
+
+	conn = dialTestServer(t, url+"?session_token="+session.Token)
+	defer conn.Close()
+	if event := readTestEvent(t, conn); event.Identifier != "missed" {
+		t.Errorf("expected buffered event first, got %+v", event)
+	}
+	var resumed SessionData
+	raw, _ = json.Marshal(readTestEvent(t, conn).Data)
+	_ = json.Unmarshal(raw, &resumed)
+	if !resumed.Resumed || resumed.ID != session.ID || resumed.Token == session.Token {
+		t.Errorf("unexpected resumed session %+v", resumed)
+	}
+	client := GetClient(session.ID)
+	if name, _ := client.GetMeta("name"); name != "resumable" || len(client.GetRooms()) != 1 {
+		t.Errorf("expected metadata and rooms to be restored")
+	}
+	select {
+	case id := <-disconnected:
+		t.Errorf("OnDisconnect called for resumed client %s", id)
+	default:
+	}
+
+	_ = conn.Close()
+	select {
+	case id := <-disconnected:
+		if id != session.ID {
+			t.Errorf("unexpected client disconnected %s", id)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("OnDisconnect not called after the grace period")
+	}
+}
@@ -0,0 +1,224 @@
+package groWs
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// poolWatcher is notified about changes of a ClientPool (called while the pool is locked)
+type poolWatcher interface {
+	clientAdded(client *Client)
+	clientRemoved(client *Client)
+	roomJoined(client *Client, room string)
+	roomLeft(client *Client, room string)
+}
+
+// subscriptions subscribes the node to the channels needed by its clients
+// Every channel is reference counted by the local clients needing it (members of a room, clients of a tenant),
+// so the node only receives the room and tenant traffic of its clients.
+// The reference counts are updated while the pool is locked, the (un)subscribe calls are queued
+// and run by a separate goroutine, so the broker can not block the pool.
+type subscriptions struct {
+	mu           sync.Mutex
+	ctx          context.Context
+	subscription Subscription
+	refs         map[string]int
+	// channels held by each client
+	tenants map[*Client][]string
+	rooms   map[*Client]map[string]string
+
+	queueMu sync.Mutex
+	queue   []subscriptionChange
+	notify  chan struct{}
+}
+
+// subscriptionChange is a queued (un)subscribe call
+type subscriptionChange struct {
+	unsubscribe bool
+	channels    []string
+	// done is closed when the change (and all changes queued before) ran, it is used without channels by flush
+	done chan struct{}
+}
+
+// newSubscriptions creates a tracker for the subscription and starts running the queued changes
+func newSubscriptions(ctx context.Context, subscription Subscription) *subscriptions {
+	s := &subscriptions{
+		ctx:          ctx,
+		subscription: subscription,
+		refs:         make(map[string]int),
+		tenants:      make(map[*Client][]string),
+		rooms:        make(map[*Client]map[string]string),
+		notify:       make(chan struct{}, 1),
+	}
+	go s.run()
+	return s
+}
+
+// retain subscribes to the channels not needed by another client (mu must be held)
+func (s *subscriptions) retain(channels ...string) {
+	added := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		s.refs[channel]++
+		if s.refs[channel] == 1 {
+			added = append(added, channel)
+		}
+	}
+	if len(added) > 0 {
+		s.push(subscriptionChange{channels: added})
+	}
+}
+
+// release unsubscribes from the channels not needed by another client (mu must be held)
+func (s *subscriptions) release(channels ...string) {
+	removed := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		s.refs[channel]--
+		if s.refs[channel] <= 0 {
+			delete(s.refs, channel)
+			removed = append(removed, channel)
+		}
+	}
+	if len(removed) > 0 {
+		s.push(subscriptionChange{unsubscribe: true, channels: removed})
+	}
+}
+
+// push adds a change to the queue
+func (s *subscriptions) push(change subscriptionChange) {
+	s.queueMu.Lock()
+	s.queue = append(s.queue, change)
+	s.queueMu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// flush waits until the changes queued before ran
+func (s *subscriptions) flush() {
+	done := make(chan struct{})
+	s.push(subscriptionChange{done: done})
+	select {
+	case <-done:
+	case <-s.ctx.Done():
+	}
+}
+
+// run calls Subscribe and Unsubscribe for the queued changes in order until the context is canceled
+func (s *subscriptions) run() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.notify:
+			s.queueMu.Lock()
+			changes := s.queue
+			s.queue = nil
+			s.queueMu.Unlock()
+			for _, change := range changes {
+				s.apply(change)
+			}
+		}
+	}
+}
+
+// apply runs a queued change
+func (s *subscriptions) apply(change subscriptionChange) {
+	if change.done != nil {
+		defer close(change.done)
+	}
+	if len(change.channels) == 0 {
+		return
+	}
+	if change.unsubscribe {
+		if err := s.subscription.Unsubscribe(s.ctx, change.channels...); err != nil {
+			log.Println("pub/sub unsubscribe error: ", err)
+		}
+		return
+	}
+	if err := s.subscription.Subscribe(s.ctx, change.channels...); err != nil {
+		log.Println("pub/sub subscribe error: ", err)
+	}
+}
+
+// clientAdded subscribes to the channels of the client's tenant
+func (c *pubSubClient) clientAdded(client *Client) {
+	c.enqueuePresence(presenceUpdate{Type: PresenceConnect, Client: c.presenceClient(client)})
+	tenant := client.GetTenant()
+	if tenant == "" {
+		return
+	}
+	s := c.subscriptions
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tenants[client]; ok {
+		return
+	}
+	channels := c.baseChannels(tenant)
+	s.tenants[client] = channels
+	s.retain(channels...)
+}
+
+// clientRemoved releases the channels of the client's tenant
+func (c *pubSubClient) clientRemoved(client *Client) {
+	c.enqueuePresence(presenceUpdate{Type: PresenceDisconnect, Client: c.presenceClient(client)})
+	s := c.subscriptions
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	channels, ok := s.tenants[client]
+	if !ok {
+		return
+	}
+	delete(s.tenants, client)
+	s.release(channels...)
+}
+
+// roomJoined subscribes to the channel of the room
+func (c *pubSubClient) roomJoined(client *Client, room string) {
+	c.enqueuePresence(presenceUpdate{Type: PresenceJoin, Room: room, Client: c.presenceClient(client)})
+	s := c.subscriptions
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rooms[client] == nil {
+		s.rooms[client] = make(map[string]string)
+	}
+	if _, ok := s.rooms[client][room]; ok {
+		return
+	}
+	channel := c.channels.Room(client.GetTenant(), room)
+	s.rooms[client][room] = channel
+	s.retain(channel)
+}
+
+// roomLeft releases the channel of the room
+func (c *pubSubClient) roomLeft(client *Client, room string) {
+	c.enqueuePresence(presenceUpdate{Type: PresenceLeave, Room: room, Client: c.presenceClient(client)})
+	s := c.subscriptions
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	channel, ok := s.rooms[client][room]
+	if !ok {
+		return
+	}
+	delete(s.rooms[client], room)
+	if len(s.rooms[client]) == 0 {
+		delete(s.rooms, client)
+	}
+	s.release(channel)
+}
+
+// baseChannels returns the channels of a namespace every node with clients of the namespace subscribes to
+// The default namespace includes the channels of the node and of the presence updates.
+func (c *pubSubClient) baseChannels(tenant string) []string {
+	namespace := c.channels.Namespace(tenant)
+	channels := []string{namespace + ":client", namespace + ":all:clients", namespace + ":user", namespace + ":user:disconnect",
+		namespace + ":control"}
+	if tenant == "" {
+		channels = append(channels, c.channels.Node(c.nodeID))
+		if c.presence != nil {
+			channels = append(channels, c.channels.Presence())
+		}
+	}
+	return channels
+}
@@ -1,117 +1,93 @@
 package groWs
 
-import "log"
+// All Broadcast* and Send* functions publish to the broker, so they have the same semantics on a single node
+// and in a cluster: the message is delivered to the recipients connected to any node, delivery is not confirmed.
+// They address the clients without tenant, use Tenant(tenant) to address the clients of a tenant.
+// The package-level functions use the default app (the App created last, see NewApp). With multiple apps in one
+// process, use the methods of the app instead (e.g. app.Namespace().Broadcast and app.GetClient).
 
 // Broadcast sends a Message to all clients in a room
-func Broadcast(roomId string, message []byte) {
-	GetClientPool().SendToRoom(roomId, message)
+func Broadcast(roomId string, message []byte) error {
+	return defaultNamespace.Broadcast(roomId, message)
 }
 
 // BroadcastToAll sends a Message to all clients connected
-func BroadcastToAll(message []byte) {
-	GetClientPool().SendToAll(message)
+func BroadcastToAll(message []byte) error {
+	return defaultNamespace.BroadcastToAll(message)
 }
 
 // BroadcastEvent sends an event to all clients in a room
 func BroadcastEvent(roomId string, event Event) error {
-	json, err := event.ToJSON()
-	if err != nil {
-		return err
-	}
-
-	if pubSubEnabled {
-		return getPubSubClient().PublishEventToRoom(roomId, event)
-	} else {
-		GetClientPool().SendToRoom(roomId, json)
-	}
-	return nil
+	return defaultNamespace.BroadcastEvent(roomId, event)
 }
 
 // BroadcastEventToAll sends an event to all clients
 func BroadcastEventToAll(event Event) error {
-	json, err := event.ToJSON()
-	if err != nil {
-		return err
-	}
-	if pubSubEnabled {
-		return getPubSubClient().PublishEventToAll(event)
-	} else {
-		GetClientPool().SendToAll(json)
-	}
-	return nil
+	return defaultNamespace.BroadcastEventToAll(event)
 }
 
 // BroadcastExcept sends a Message to all clients except the client with the given id
 func BroadcastExcept(id string, message []byte) error {
-	if pubSubEnabled {
-		return getPubSubClient().PublishToAllExcept(id, message)
-	} else {
-		GetClientPool().SendToAllExcept(id, message)
-	}
-	return nil
+	return defaultNamespace.BroadcastExcept(id, message)
 }
 
 // BroadcastEventExcept sends an event to all clients except the client with the given Id
 func BroadcastEventExcept(id string, event Event) error {
-	json, err := event.ToJSON()
-	if err != nil {
-		return err
-	}
-	if pubSubEnabled {
-		return getPubSubClient().PublishEventToAllExcept(id, event)
-	} else {
-		GetClientPool().SendToAllExcept(id, json)
-	}
-	return nil
+	return defaultNamespace.BroadcastEventExcept(id, event)
 }
 
 // BroadcastByMeta sends a Message to all clients with a specific metadata
-// TODO: implement pub/sub
-func BroadcastByMeta(key string, value interface{}, message []byte) {
-	if pubSubEnabled {
-		//return getPubSubClient().PublishToAllByMeta(key, value, message)
-		log.Println("Pub/Sub not implemented for BroadcastByMeta")
-	}
+func BroadcastByMeta(key string, value interface{}, message []byte) error {
+	return defaultNamespace.BroadcastByMeta(key, value, message)
+}
 
-	GetClientPool().SendToAllByMeta(key, value, message)
+// BroadcastEventByMeta sends an event to all clients with a specific metadata
+func BroadcastEventByMeta(key string, value interface{}, event Event) error {
+	return defaultNamespace.BroadcastEventByMeta(key, value, event)
+}
 
+// BroadcastByFilter sends a Message to all clients matching the metadata filter
+func BroadcastByFilter(filter MetaFilter, message []byte) error {
+	return defaultNamespace.BroadcastByFilter(filter, message)
 }
 
-// BroadcastEventByMeta sends an event to all clients with a specific metadata
-// TODO: implement pub/sub
-func BroadcastEventByMeta(key string, value interface{}, event Event) {
-	//Convert event to json
-	json, err := event.ToJSON()
-	if err != nil {
-		return
-	}
-	if pubSubEnabled {
-		// getPubSubClient().PublishEventToAllByMeta(key, value, event)
-		log.Println("Pub/Sub not implemented for BroadcastEventByMeta")
-	}
-	GetClientPool().SendToAllByMeta(key, value, json)
+// BroadcastEventByFilter sends an event to all clients matching the metadata filter
+func BroadcastEventByFilter(filter MetaFilter, event Event) error {
+	return defaultNamespace.BroadcastEventByFilter(filter, event)
 }
 
 // BroadcastToClient sends a Message to a client with the given Id
 func BroadcastToClient(id string, message []byte) error {
-	if pubSubEnabled {
-		return getPubSubClient().PublishToClient(id, message)
-	} else {
-		return GetClientPool().SendToClient(id, message)
-	}
+	return defaultNamespace.BroadcastToClient(id, message)
 }
 
 // BroadcastEventToClient sends an event to a client with the given Id
 func BroadcastEventToClient(id string, event Event) error {
-	json, err := event.ToJSON()
-	if err != nil {
-		return err
-	}
-	if pubSubEnabled {
-		return getPubSubClient().PublishEventToClient(id, event)
-	} else {
-		return GetClientPool().SendToClient(id, json)
+	return defaultNamespace.BroadcastEventToClient(id, event)
+}
+
+// SendToUser sends a Message to all clients of a user (see Client.SetUserID)
+func SendToUser(userID string, message []byte) error {
+	return defaultNamespace.SendToUser(userID, message)
+}
+
+// SendEventToUser sends an event to all clients of a user
+func SendEventToUser(userID string, event Event) error {
+	return defaultNamespace.SendEventToUser(userID, event)
+}
+
+// DisconnectUser closes the connections of all clients of a user
+func DisconnectUser(userID string) error {
+	return defaultNamespace.DisconnectUser(userID)
+}
+
+// GetUserConnections returns the ids of all clients of a user connected to this node
+func GetUserConnections(userID string) []string {
+	clientIds := make([]string, 0)
+	for _, client := range GetClientPool().GetUserClients(userID) {
+		clientIds = append(clientIds, client.GetID())
 	}
+	return clientIds
 }
 
 // GetConnectedClientIds returns a list of all connected client ids
@@ -142,20 +118,30 @@ func GetConnectedClientIdsByRoom(roomId string) []string {
 	return clientIds
 }
 
-// GetClient returns a client with the given ID
+// GetClient returns a client of the default app with the given ID
 func GetClient(id string) *Client {
 	return GetClientPool().GetClient(id)
 }
 
+// GetClient returns a client of the app connected to this node with the given ID
+func (a *App) GetClient(id string) *Client {
+	return a.pool.GetClient(id)
+}
+
 // AddClientToRoom adds a client to a room
-func AddClientToRoom(client *Client, roomId string) {
-	GetClientPool().AddClientToRoom(client, roomId)
+// It returns ErrAccessDenied (and sends an error event to the client) if the ACL does not allow joining the room
+func AddClientToRoom(client *Client, roomId string) error {
+	if err := client.acl().authorizeOrReply(client, ActionJoin, roomId); err != nil {
+		return err
+	}
+	client.getPool().AddClientToRoom(client, roomId)
 	client.joinRoom(roomId)
+	return nil
 }
 
 // RemoveClientFromRoom removes a client from a room
 func RemoveClientFromRoom(client *Client, roomId string) {
-	GetClientPool().RemoveClientFromRoom(client, roomId)
+	client.getPool().RemoveClientFromRoom(client, roomId)
 	client.leaveRoom(roomId)
 }
 
@@ -0,0 +1,123 @@
+package groWs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-playground/validator/v10"
+	"reflect"
+	"strings"
+)
+
+// structValidate is the shared validator instance used by StructValidator
+// field names in violations are taken from the json tag if present
+var structValidate = newStructValidate()
+
+// ErrNilSchema is the panic value of StructValidator called without schema
+var ErrNilSchema = errors.New("validator schema is nil")
+
+// Violation describes a single reason why the data of an event is invalid
+type Violation struct {
+	// Field is the path of the invalid field (e.g. "user.name"), empty if the whole data is invalid
+	Field string `json:"field,omitempty"`
+	// Message describes the violation
+	Message string `json:"message"`
+}
+
+// Validator validates the data of an incoming Event before the handler is called
+// If a Validator returns violations the handler is not called and an error event is sent to the client
+type Validator interface {
+	Validate(data any) []Violation
+}
+
+// ValidatorFunc is an adapter to use an ordinary function as Validator
+type ValidatorFunc func(data any) []Violation
+
+// Validate calls f(data)
+func (f ValidatorFunc) Validate(data any) []Violation {
+	return f(data)
+}
+
+// StructValidator returns a Validator that decodes the event data into a new value of the type of schema
+// and validates it using `validate` struct tags (see github.com/go-playground/validator)
+// It panics with ErrNilSchema if schema is nil (like regexp.MustCompile, so the mistake shows up on startup)
+// Example:
+//
+//	type ChatMessage struct {
+//		Room string `json:"room" validate:"required"`
+//		Text string `json:"text" validate:"required,max=500"`
+//	}
+//	handler.ValidateEvent("chat", groWs.StructValidator(ChatMessage{}))
+func StructValidator(schema any) Validator {
+	schemaType := reflect.TypeOf(schema)
+	if schemaType == nil {
+		panic(ErrNilSchema)
+	}
+	for schemaType.Kind() == reflect.Pointer {
+		schemaType = schemaType.Elem()
+	}
+	return ValidatorFunc(func(data any) []Violation {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return []Violation{{Message: err.Error()}}
+		}
+		value := reflect.New(schemaType)
+		if err := json.Unmarshal(raw, value.Interface()); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				return []Violation{{
+					Field:   typeErr.Field,
+					Message: fmt.Sprintf("must be of type %s", typeErr.Type.String()),
+				}}
+			}
+			return []Violation{{Message: err.Error()}}
+		}
+		if schemaType.Kind() != reflect.Struct {
+			return nil
+		}
+		err = structValidate.Struct(value.Interface())
+		var validationErrors validator.ValidationErrors
+		if !errors.As(err, &validationErrors) {
+			return nil
+		}
+		violations := make([]Violation, 0, len(validationErrors))
+		for _, fieldErr := range validationErrors {
+			violations = append(violations, Violation{
+				Field:   trimNamespace(fieldErr.Namespace()),
+				Message: violationMessage(fieldErr),
+			})
+		}
+		return violations
+	})
+}
+
+func newStructValidate() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return field.Name
+		}
+		return name
+	})
+	return v
+}
+
+// trimNamespace removes the name of the top level struct from a validator namespace
+func trimNamespace(namespace string) string {
+	if i := strings.IndexByte(namespace, '.'); i >= 0 {
+		return namespace[i+1:]
+	}
+	return namespace
+}
+
+// violationMessage builds a readable message for a failed validation rule
+func violationMessage(fieldErr validator.FieldError) string {
+	if fieldErr.Param() != "" {
+		return fmt.Sprintf("failed on the '%s=%s' rule", fieldErr.Tag(), fieldErr.Param())
+	}
+	return fmt.Sprintf("failed on the '%s' rule", fieldErr.Tag())
+}
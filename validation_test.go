@@ -0,0 +1,32 @@
+package groWs
+
+import "testing"
+
+type testChatMessage struct {
+	Room string `json:"room" validate:"required"`
+	Text string `json:"text" validate:"required,max=5"`
+}
+
+func TestStructValidator(t *testing.T) {
+	v := StructValidator(testChatMessage{})
+	if violations := v.Validate(map[string]any{"room": "a", "text": "hi"}); len(violations) != 0 {
+		t.Errorf("expected no violations, got %+v", violations)
+	}
+	violations := v.Validate(map[string]any{"text": "too long"})
+	if len(violations) != 2 {
+		t.Fatalf("expected 2 violations, got %+v", violations)
+	}
+	if violations[0].Field != "room" || violations[1].Field != "text" {
+		t.Errorf("unexpected fields %+v", violations)
+	}
+	violations = v.Validate(map[string]any{"room": 1})
+	if len(violations) != 1 || violations[0].Field != "room" {
+		t.Errorf("expected type violation for room, got %+v", violations)
+	}
+	defer func() {
+		if recovered := recover(); recovered != ErrNilSchema {
+			t.Errorf("expected panic with ErrNilSchema, got %v", recovered)
+		}
+	}()
+	StructValidator(nil)
+}